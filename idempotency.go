@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/ccp0101/queues/store"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// replay is a response remembered under an idempotency key.
+type replay struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type"`
+	Body        []byte `json:"body"`
+}
+
+// recorder keeps a copy of the response body written through it.
+type recorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotent remembers the response to a request carrying an
+// Idempotency-Key header for the queue's idempotency window, under
+// "<path>-<key>", and answers requests that repeat the key on the same path
+// with it instead of running the handler again. A repeat arriving while the
+// first request is still being handled gets a 409. Only successes and
+// 409s, which refuse duplicates on purpose, are remembered: a request that
+// failed, as on a queue that did not exist yet, may be retried.
+func idempotent(s store.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.Request.Header.Get("Idempotency-Key")
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		qid := c.Param("qid")
+		settings, err := s.Settings(qid)
+		if err != nil {
+			panic(err)
+		}
+		window := settings.IdempotencyWindow
+		if window == 0 {
+			c.Next()
+			return
+		}
+		name := c.Request.URL.Path + "-" + key
+		saved, claimed, err := s.ClaimIdempotencyKey(qid, name, window)
+		if err != nil {
+			panic(err)
+		}
+		if !claimed {
+			c.Abort()
+			if len(saved) == 0 {
+				c.String(http.StatusConflict, "A request with this Idempotency-Key is in progress.")
+				return
+			}
+			var response replay
+			if err := json.Unmarshal(saved, &response); err != nil {
+				panic(err)
+			}
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(response.Status, response.ContentType, response.Body)
+			return
+		}
+
+		forget := func() {
+			s.ForgetIdempotencyKey(qid, name)
+		}
+		defer func() {
+			if err := recover(); err != nil {
+				forget()
+				panic(err)
+			}
+		}()
+		w := &recorder{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+
+		if !remembered(w.Status()) {
+			forget()
+			return
+		}
+		response, err := json.Marshal(replay{w.Status(), w.Header().Get("Content-Type"), w.body.Bytes()})
+		if err != nil {
+			panic(err)
+		}
+		if err := s.SaveIdempotencyKey(qid, name, response, window); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// remembered tells whether the response with the given status is saved
+// under its idempotency key.
+func remembered(status int) bool {
+	return status >= 200 && status < 300 || status == http.StatusConflict
+}
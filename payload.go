@@ -0,0 +1,16 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// newItemID returns an ID for an item enqueued with a payload but without
+// an ID of its own.
+func newItemID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
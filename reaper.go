@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ccp0101/queues/store"
+	"log"
+	"os"
+	"time"
+)
+
+// reaper requeues items whose lease has expired. Every replica runs one, but
+// only the replica holding the leader lease in the store actually reaps.
+type reaper struct {
+	store    store.Store
+	id       string
+	interval time.Duration
+}
+
+func newReaper(s store.Store, interval time.Duration) *reaper {
+	host, _ := os.Hostname()
+	return &reaper{
+		store:    s,
+		id:       fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano()),
+		interval: interval,
+	}
+}
+
+// run reaps every interval until the process exits.
+func (rp *reaper) run() {
+	for {
+		time.Sleep(rp.interval)
+		if err := rp.tick(); err != nil {
+			log.Printf("Reaper: %v", err)
+		}
+	}
+}
+
+func (rp *reaper) tick() error {
+	// The lease outlives a few intervals so a leader that misses one tick
+	// keeps its role, while a dead leader is replaced soon enough.
+	leader, err := rp.store.Lead(rp.id, 3*rp.interval)
+	if err != nil || !leader {
+		return err
+	}
+	return reap(rp.store)
+}
+
+// reap puts expired items of every queue back to their queued list.
+func reap(s store.Store) error {
+	qids, err := s.Queues()
+	if err != nil {
+		return err
+	}
+
+	for _, qid := range qids {
+		requeued, dead, err := s.Reap(qid)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range requeued {
+			log.Printf("Put expired item %v back to queue %v", item, qid)
+		}
+		for _, item := range dead {
+			log.Printf("Moved expired item %v of queue %v to dead", item, qid)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// redisOptions are how to reach and log into a Redis.
+type redisOptions struct {
+	address  string
+	username string
+	password string
+	db       int
+	tls      *tls.Config
+}
+
+// parseRedisURL parses redis[s]://[[username][:password]@]host[:port][/db].
+// The port defaults to 6379 and the database to 0. rediss connects over
+// TLS, verifying the server against the CA certificates in the PEM file at
+// REDIS_TLS_CA if set, or else the system's, and presenting the client
+// certificate in REDIS_TLS_CERT and REDIS_TLS_KEY if set.
+// REDIS_TLS_SKIP_VERIFY=1 accepts any server certificate, as providers
+// with self-signed certificates need.
+func parseRedisURL(rawurl string) (*redisOptions, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("REDIS_URL: unknown scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("REDIS_URL: no host")
+	}
+
+	o := &redisOptions{address: u.Host}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		o.address = net.JoinHostPort(strings.Trim(u.Host, "[]"), "6379")
+	}
+	if u.User != nil {
+		o.username = u.User.Username()
+		o.password, _ = u.User.Password()
+	}
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		if o.db, err = strconv.Atoi(path); err != nil {
+			return nil, fmt.Errorf("REDIS_URL: database %q is not a number", path)
+		}
+	}
+	if u.Scheme == "rediss" {
+		if o.tls, err = redisTLSConfig(); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+func redisTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: os.Getenv("REDIS_TLS_SKIP_VERIFY") == "1"}
+	if path := os.Getenv("REDIS_TLS_CA"); path != "" {
+		pem, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("REDIS_TLS_CA: no certificates in %v", path)
+		}
+	}
+	if certFile := os.Getenv("REDIS_TLS_CERT"); certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, os.Getenv("REDIS_TLS_KEY"))
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// dial connects, logs in and selects the database, for every connection of
+// the pool and the ones Wait dials.
+func (o *redisOptions) dial() (redis.Conn, error) {
+	var options []redis.DialOption
+	if o.tls != nil {
+		options = append(options, redis.DialNetDial(func(network, addr string) (net.Conn, error) {
+			return tls.Dial(network, addr, o.tls)
+		}))
+	}
+	c, err := redis.Dial("tcp", o.address, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := o.auth(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if o.db != 0 {
+		if _, err := c.Do("SELECT", o.db); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// auth logs in as the user if there is one. Redis before 6 has no users,
+// and providers such as Redis To Go put one in the URL all the same, so a
+// server refusing a username gets the password alone. Any other refusal,
+// such as WRONGPASS for an unknown user, is an error: logging in as the
+// default user instead would hand out its privileges.
+func (o *redisOptions) auth(c redis.Conn) error {
+	if o.password == "" {
+		return nil
+	}
+	if o.username != "" {
+		_, err := c.Do("AUTH", o.username, o.password)
+		e, ok := err.(redis.Error)
+		if !ok || !strings.Contains(strings.ToLower(string(e)), "wrong number of arguments") {
+			return err
+		}
+	}
+	_, err := c.Do("AUTH", o.password)
+	return err
+}
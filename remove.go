@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"github.com/ccp0101/queues/store"
+	"regexp"
+	"strings"
+)
+
+// removeWhere checks the from parameter of /remove and /purge, all if not
+// given.
+func removeWhere(from string) (string, error) {
+	switch from {
+	case "":
+		return store.RemoveAll, nil
+	case store.RemoveQueued, store.RemoveScheduled, store.RemoveAll:
+		return from, nil
+	}
+	return "", errors.New("from must be queued, scheduled or all.")
+}
+
+// itemMatcher returns a filter keeping items that start with prefix or match
+// pattern, whichever is given.
+func itemMatcher(prefix, pattern string) (func(string) bool, error) {
+	if prefix != "" && pattern != "" {
+		return nil, errors.New("give either prefix or regex, not both.")
+	}
+	if prefix != "" {
+		return func(item string) bool {
+			return strings.HasPrefix(item, prefix)
+		}, nil
+	}
+	if pattern == "" {
+		return nil, errors.New("prefix or regex is required.")
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errors.New("regex is invalid: " + err.Error())
+	}
+	return re.MatchString, nil
+}
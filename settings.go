@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ccp0101/queues/store"
+	"github.com/gin-gonic/gin"
+	"math"
+	"strconv"
+	"time"
+)
+
+// updateSettings overrides the settings given as form values in the
+// request.
+func updateSettings(s *store.Settings, c *gin.Context) error {
+	for field, v := range s.Fields() {
+		if value, ok := c.GetPostForm(field); ok {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("%s must be a non-negative number.", field)
+			}
+			*v = n
+		}
+	}
+	if value, ok := c.GetPostForm("backoff_factor"); ok {
+		factor, err := strconv.ParseFloat(value, 64)
+		if err != nil || !(factor > 0) || math.IsInf(factor, 0) {
+			return errors.New("backoff_factor must be a positive number.")
+		}
+		s.BackoffFactor = factor
+	}
+	if dedupe, ok := c.GetPostForm("dedupe"); ok {
+		switch dedupe {
+		case store.DedupeOff, store.DedupeReject, store.DedupeIgnore:
+			s.Dedupe = dedupe
+		default:
+			return errors.New("dedupe must be off, reject or ignore.")
+		}
+	}
+	if s.Lease == 0 {
+		return errors.New("lease must be positive.")
+	}
+	for _, field := range []string{"lease", "max_lease", "max_extend"} {
+		if *s.Fields()[field] > store.LeaseLimit {
+			return fmt.Errorf("%s must not exceed %d.", field, store.LeaseLimit)
+		}
+	}
+	if s.MaxLease > 0 && s.Lease > s.MaxLease {
+		return errors.New("lease must not exceed max_lease.")
+	}
+	if s.BackoffJitter > 100 {
+		return errors.New("backoff_jitter must not exceed 100.")
+	}
+	return nil
+}
+
+// updateOrder overrides the order if given in the request. Only /new calls
+// it: changing the order would not reorder the items already queued.
+func updateOrder(s *store.Settings, c *gin.Context) error {
+	order, ok := c.GetPostForm("order")
+	if !ok {
+		return nil
+	}
+	switch order {
+	case store.OrderFIFO, store.OrderLIFO, store.OrderRandom:
+		s.Order = order
+		return nil
+	}
+	return errors.New("order must be fifo, lifo or random.")
+}
+
+// deadline formats the end of a lease of the given seconds starting now.
+func deadline(now time.Time, seconds int) string {
+	return now.Add(time.Duration(seconds) * time.Second).UTC().Format(time.RFC3339)
+}
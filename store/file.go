@@ -0,0 +1,403 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// File keeps queues in memory as Memory does and makes them durable in a
+// directory, for a single process on a single node.
+//
+// Every op is appended to the "log" file and synced to disk before it is
+// applied, so a change is never acknowledged before it is durable. Every
+// compactInterval, the whole state is written to the "snapshot" file, which
+// replaces the old one atomically, and the log is emptied. On start the
+// snapshot is loaded and the ops logged since are applied again; each op
+// carries its time and random seed so that it makes the same change. A
+// record torn by a crash while it was being written was never acknowledged
+// and is dropped.
+type File struct {
+	*Memory
+	dir     string
+	log     *os.File
+	size    int64
+	seq     int64
+	logged  int
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// NewFile opens the queues kept in dir, creating it if needed, and compacts
+// the log every compactInterval.
+func NewFile(dir string, compactInterval time.Duration) (*File, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &File{Memory: NewMemory(), dir: dir, stop: make(chan struct{}), stopped: make(chan struct{})}
+	if err := s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(s.path("log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.log = f
+	s.Memory.journal = s.append
+	go s.run(compactInterval)
+	return s, nil
+}
+
+func (s *File) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+// Close compacts the log and closes it.
+func (s *File) Close() error {
+	close(s.stop)
+	<-s.stopped
+	err := s.compact()
+	if closeErr := s.log.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *File) run(interval time.Duration) {
+	defer close(s.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.compact(); err != nil {
+				log.Printf("Compacting %v: %v", s.dir, err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// append writes an op to the log and syncs it. A failed write is cut off so
+// that the log stays readable.
+func (s *File) append(op *memoryOp) error {
+	op.Seq = s.seq + 1
+	record, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	record = append(record, '\n')
+	if _, err := s.log.Write(record); err != nil {
+		s.log.Truncate(s.size)
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		s.log.Truncate(s.size)
+		return err
+	}
+	s.size += int64(len(record))
+	s.seq = op.Seq
+	s.logged++
+	return nil
+}
+
+// replay applies the ops logged after the snapshot.
+func (s *File) replay() error {
+	f, err := os.Open(s.path("log"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		record, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(record) > 0 {
+				log.Printf("Dropping a torn record at the end of %v", s.path("log"))
+				if err := os.Truncate(s.path("log"), offset); err != nil {
+					return err
+				}
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var op memoryOp
+		if err := json.Unmarshal(record, &op); err != nil {
+			return fmt.Errorf("%v at offset %d: %v", s.path("log"), offset, err)
+		}
+		offset += int64(len(record))
+		// Ops up to the snapshot are in it already, if compaction stopped
+		// between writing the snapshot and emptying the log.
+		if op.Seq <= s.seq {
+			continue
+		}
+		s.Memory.apply(&op)
+		s.seq = op.Seq
+		s.logged++
+	}
+	s.size = offset
+	return nil
+}
+
+// compact writes a snapshot of every queue and empties the log. Ops wait
+// meanwhile.
+func (s *File) compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.logged == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(s.snapshot())
+	if err != nil {
+		return err
+	}
+	if err := writeFile(s.path("snapshot"), data); err != nil {
+		return err
+	}
+	if err := s.log.Truncate(0); err != nil {
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+	s.size, s.logged = 0, 0
+	return nil
+}
+
+// writeFile replaces a file with data such that a crash leaves either the
+// old file or the new one.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (s *File) loadSnapshot() error {
+	data, err := ioutil.ReadFile(s.path("snapshot"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snapshot fileSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("%v: %v", s.path("snapshot"), err)
+	}
+	s.restore(snapshot)
+	return nil
+}
+
+// fileSnapshot is the state of a File store as of the op numbered Seq. Times
+// are unix nanoseconds. Payloads are bytes so that they need not be UTF-8.
+type fileSnapshot struct {
+	Seq         int64                                  `json:"seq"`
+	Queues      map[string]queueSnapshot               `json:"queues"`
+	Idempotency map[string]map[string]responseSnapshot `json:"idempotency"`
+}
+
+type queueSnapshot struct {
+	Settings   Settings                 `json:"settings"`
+	Queued     map[int][]string         `json:"queued"`
+	Priorities []int                    `json:"priorities"`
+	Priority   map[string]int           `json:"priority"`
+	Pending    map[string]leaseSnapshot `json:"pending"`
+	Delivered  map[string]string        `json:"delivered"`
+	Leases     int                      `json:"leases"`
+	Attempts   map[string]int           `json:"attempts"`
+	Done       []string                 `json:"done"`
+	Dead       []string                 `json:"dead"`
+	Scheduled  map[string]float64       `json:"scheduled"`
+	Payloads   map[string][]byte        `json:"payloads"`
+	Present    map[string]int           `json:"present"`
+	Recent     map[string]int64         `json:"recent"`
+	Meta       map[string]metaSnapshot  `json:"meta"`
+}
+
+type leaseSnapshot struct {
+	IP       string `json:"ip"`
+	Deadline int64  `json:"deadline"`
+	Expires  int64  `json:"expires"`
+}
+
+type metaSnapshot struct {
+	State     string  `json:"state"`
+	Updated   int64   `json:"updated"`
+	Enqueued  int64   `json:"enqueued,omitempty"`
+	Leased    int64   `json:"leased,omitempty"`
+	Completed int64   `json:"completed,omitempty"`
+	Due       float64 `json:"due,omitempty"`
+	Token     string  `json:"token,omitempty"`
+}
+
+type responseSnapshot struct {
+	Response []byte `json:"response"`
+	Expires  int64  `json:"expires"`
+}
+
+// snapshot copies the state out. The lock must be held.
+func (s *File) snapshot() fileSnapshot {
+	snapshot := fileSnapshot{
+		Seq:         s.seq,
+		Queues:      make(map[string]queueSnapshot),
+		Idempotency: make(map[string]map[string]responseSnapshot),
+	}
+	for qid, q := range s.queues {
+		qs := queueSnapshot{
+			Settings:  q.settings,
+			Queued:    make(map[int][]string),
+			Priority:  q.priority,
+			Pending:   make(map[string]leaseSnapshot),
+			Delivered: q.delivered,
+			Leases:    q.leases,
+			Attempts:  q.attempts,
+			Done:      q.done,
+			Dead:      q.dead,
+			Scheduled: q.scheduled,
+			Payloads:  make(map[string][]byte),
+			Present:   q.present,
+			Recent:    q.recent,
+			Meta:      make(map[string]metaSnapshot),
+		}
+		for item, payload := range q.payloads {
+			qs.Payloads[item] = []byte(payload)
+		}
+		for priority, l := range q.queued {
+			var items []string
+			for e := l.Front(); e != nil; e = e.Next() {
+				items = append(items, e.Value.(string))
+			}
+			qs.Queued[priority] = items
+		}
+		for priority := range q.priorities {
+			qs.Priorities = append(qs.Priorities, priority)
+		}
+		for token, lease := range q.pending {
+			qs.Pending[token] = leaseSnapshot{lease.ip, lease.deadline, unixNano(lease.expires)}
+		}
+		for item, meta := range q.meta {
+			qs.Meta[item] = metaSnapshot{meta.state, meta.updated, meta.enqueued, meta.leased, meta.completed,
+				meta.due, meta.token}
+		}
+		snapshot.Queues[qid] = qs
+	}
+	for qid, keys := range s.idempotency {
+		snapshot.Idempotency[qid] = make(map[string]responseSnapshot)
+		for name, saved := range keys {
+			snapshot.Idempotency[qid][name] = responseSnapshot{saved.response, unixNano(saved.expires)}
+		}
+	}
+	return snapshot
+}
+
+// restore copies a snapshot in.
+func (s *File) restore(snapshot fileSnapshot) {
+	s.seq = snapshot.Seq
+	for qid, qs := range snapshot.Queues {
+		q := newMemoryQueue(qs.Settings)
+		for priority, items := range qs.Queued {
+			for _, item := range items {
+				q.list(priority).PushBack(item)
+			}
+		}
+		for _, priority := range qs.Priorities {
+			q.priorities[priority] = true
+		}
+		for token, lease := range qs.Pending {
+			q.pending[token] = &memoryLease{lease.IP, lease.Deadline, fromUnixNano(lease.Expires)}
+			q.deadlines.set(token, float64(lease.Deadline))
+		}
+		for item, meta := range qs.Meta {
+			q.meta[item] = &memoryMeta{meta.State, meta.Updated, meta.Enqueued, meta.Leased, meta.Completed,
+				meta.Due, meta.Token}
+		}
+		q.leases, q.done, q.dead = qs.Leases, qs.Done, qs.Dead
+		copyMap(q.priority, qs.Priority)
+		copyMap(q.attempts, qs.Attempts)
+		copyMap(q.present, qs.Present)
+		for item, token := range qs.Delivered {
+			q.delivered[item] = token
+		}
+		for item, payload := range qs.Payloads {
+			q.payloads[item] = string(payload)
+		}
+		for member, due := range qs.Scheduled {
+			q.scheduled[member] = due
+			q.dues.set(member, due)
+		}
+		for item, at := range qs.Recent {
+			q.recent[item] = at
+			q.completions.set(item, float64(at))
+		}
+		s.queues[qid] = q
+	}
+	for qid, keys := range snapshot.Idempotency {
+		s.idempotency[qid] = make(map[string]*memoryResponse)
+		for name, saved := range keys {
+			s.idempotency[qid][name] = &memoryResponse{saved.Response, fromUnixNano(saved.Expires)}
+		}
+	}
+}
+
+func copyMap(dst, src map[string]int) {
+	for k, v := range src {
+		dst[k] = v
+	}
+}
+
+// unixNano returns the unix nanoseconds of t, 0 for the zero time.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
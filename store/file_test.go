@@ -0,0 +1,262 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "queues-file-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func openFile(t *testing.T, dir string) *File {
+	s, err := NewFile(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// crash stops a store as a crash would, without compacting.
+func crash(s *File) {
+	close(s.stop)
+	<-s.stopped
+	s.log.Close()
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func checkQueued(t *testing.T, s Store, qid string, want []string) {
+	queued, err := s.List(qid, StateQueued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(queued, want) {
+		t.Errorf("queued %q, want %q", queued, want)
+	}
+}
+
+func TestFileReplay(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openFile(t, dir)
+	if _, err := s.CreateQueue("q", DefaultSettings); err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []string{"a", "b", "c"} {
+		if _, err := s.Enqueue("q", Entry{Item: item}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leases, err := s.Next("q", "1.2.3.4", 60, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Done("q", leases[:1]); err != nil {
+		t.Fatal(err)
+	}
+	crash(s)
+
+	s = openFile(t, dir)
+	defer s.Close()
+	checkQueued(t, s, "q", []string{"c"})
+	done, _ := s.List("q", StateDone)
+	if !reflect.DeepEqual(done, []string{"a"}) {
+		t.Errorf("done %q, want [a]", done)
+	}
+	pending, _ := s.Pending("q")
+	if len(pending) != 1 || pending[0].Item != "b" || pending[0].IP != "1.2.3.4" {
+		t.Errorf("pending %+v, want b leased to 1.2.3.4", pending)
+	}
+	if ttl, err := s.TTL("q", "b", leases[1].Token); err != nil || ttl <= 0 || ttl > 60 {
+		t.Errorf("TTL of b = %v, %v, want up to 60", ttl, err)
+	}
+
+	leases, _ = s.Next("q", "1.2.3.4", 60, 1)
+	if len(leases) != 1 || leases[0].Token != "c:3" {
+		t.Errorf("leased %+v after replay, want c:3", leases)
+	}
+}
+
+func TestFileTornRecord(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openFile(t, dir)
+	s.CreateQueue("q", DefaultSettings)
+	s.Enqueue("q", Entry{Item: "a"})
+	crash(s)
+
+	logPath := filepath.Join(dir, "log")
+	size := fileSize(t, logPath)
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"enqueue","qid":"q","entry":{"Item":"b"`)
+	f.Close()
+
+	s = openFile(t, dir)
+	checkQueued(t, s, "q", []string{"a"})
+	if got := fileSize(t, logPath); got != size {
+		t.Errorf("log is %d bytes after the torn record, want %d", got, size)
+	}
+
+	// The log takes records again after the torn one was cut off.
+	s.Enqueue("q", Entry{Item: "c"})
+	crash(s)
+	s = openFile(t, dir)
+	defer s.Close()
+	checkQueued(t, s, "q", []string{"c", "a"})
+}
+
+func TestFileCorruptRecord(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openFile(t, dir)
+	s.CreateQueue("q", DefaultSettings)
+	crash(s)
+
+	f, err := os.OpenFile(filepath.Join(dir, "log"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("not json\n")
+	f.Close()
+
+	if _, err := NewFile(dir, time.Hour); err == nil {
+		t.Error("opened a log with a complete record that is not json")
+	}
+}
+
+func TestFileCompact(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openFile(t, dir)
+	s.CreateQueue("q", Settings{Lease: 30, BackoffFactor: 1.5, Order: OrderLIFO, Dedupe: DedupeReject})
+	s.Enqueue("q", Entry{Item: "a", Priority: 2, Payload: "x"})
+	s.Enqueue("q", Entry{Item: "b"})
+	s.Enqueue("q", Entry{Item: "later", Due: time.Now().Unix() + 600})
+	if err := s.compact(); err != nil {
+		t.Fatal(err)
+	}
+	if size := fileSize(t, filepath.Join(dir, "log")); size != 0 {
+		t.Errorf("log is %d bytes after compacting, want 0", size)
+	}
+	s.Enqueue("q", Entry{Item: "c"})
+	crash(s)
+
+	s = openFile(t, dir)
+	settings, _ := s.Settings("q")
+	if settings.BackoffFactor != 1.5 || settings.Order != OrderLIFO || settings.Dedupe != DedupeReject {
+		t.Errorf("settings %v after compacting", settings)
+	}
+	checkQueued(t, s, "q", []string{"a", "b", "c"})
+	if status, _ := s.Enqueue("q", Entry{Item: "later"}); status != StatusDuplicate {
+		t.Errorf("enqueueing a scheduled item again = %v, want %v", status, StatusDuplicate)
+	}
+	scheduled, _ := s.Scheduled("q")
+	if len(scheduled) != 1 || scheduled[0].Item != "later" {
+		t.Errorf("scheduled %+v, want later", scheduled)
+	}
+	leases, _ := s.Next("q", "", 0, 1)
+	if len(leases) != 1 || leases[0].Item != "a" || leases[0].Payload != "x" {
+		t.Errorf("leased %+v, want a with its payload", leases)
+	}
+
+	// Close compacts too.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if size := fileSize(t, filepath.Join(dir, "log")); size != 0 {
+		t.Errorf("log is %d bytes after closing, want 0", size)
+	}
+	s = openFile(t, dir)
+	defer s.Close()
+	checkQueued(t, s, "q", []string{"b", "c"})
+	pending, _ := s.Pending("q")
+	if len(pending) != 1 || pending[0].Item != "a" {
+		t.Fatalf("pending %+v, want a", pending)
+	}
+	s.Expire("q", "a", leases[0].Token)
+	if requeued, _, _ := s.Reap("q"); !reflect.DeepEqual(requeued, []string{"a"}) {
+		t.Errorf("reaped %v after restoring, want [a]", requeued)
+	}
+}
+
+// A crash between writing the snapshot and emptying the log leaves ops in
+// the log that the snapshot has already.
+func TestFileSnapshotSkipsLoggedOps(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openFile(t, dir)
+	s.CreateQueue("q", DefaultSettings)
+	s.Enqueue("q", Entry{Item: "a"})
+	logPath := filepath.Join(dir, "log")
+	logged, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.compact(); err != nil {
+		t.Fatal(err)
+	}
+	crash(s)
+	if err := ioutil.WriteFile(logPath, logged, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openFile(t, dir)
+	checkQueued(t, s, "q", []string{"a"})
+	s.Enqueue("q", Entry{Item: "b"})
+	crash(s)
+
+	s = openFile(t, dir)
+	defer s.Close()
+	checkQueued(t, s, "q", []string{"b", "a"})
+}
+
+func TestFileBinaryPayload(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	payload := "\xff\xfe\x00\x80x"
+	s := openFile(t, dir)
+	s.CreateQueue("q", DefaultSettings)
+	s.Enqueue("q", Entry{Item: "a", Payload: payload})
+	s.Enqueue("q", Entry{Item: "b", Payload: payload})
+	crash(s)
+
+	s = openFile(t, dir)
+	leases, _ := s.Next("q", "", 0, 1)
+	if len(leases) != 1 || leases[0].Payload != payload {
+		t.Errorf("leased %+v after replay, want payload %q", leases, payload)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openFile(t, dir)
+	defer s.Close()
+	leases, _ = s.Next("q", "", 0, 1)
+	if len(leases) != 1 || leases[0].Payload != payload {
+		t.Errorf("leased %+v after compacting, want payload %q", leases, payload)
+	}
+}
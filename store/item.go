@@ -0,0 +1,146 @@
+package store
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ItemInfo is where an item is and what happened to it.
+// Position counts the items served before a queued item. Times are RFC3339.
+type ItemInfo struct {
+	Item        string `json:"item"`
+	State       string `json:"state"`
+	Priority    int    `json:"priority"`
+	Position    *int   `json:"position,omitempty"`
+	Leaseholder string `json:"leaseholder,omitempty"`
+	TTL         *int   `json:"ttl,omitempty"`
+	Attempts    int    `json:"attempts"`
+	Enqueued    string `json:"enqueued,omitempty"`
+	Leased      string `json:"leased,omitempty"`
+	Completed   string `json:"completed,omitempty"`
+	Due         string `json:"due,omitempty"`
+	Updated     string `json:"updated,omitempty"`
+}
+
+// loadItemInfo reads the metadata the scripts keep for an item. Returns
+// redis.ErrNil if there is none.
+func loadItemInfo(r redis.Conn, qid, item string) (*ItemInfo, error) {
+	meta, err := redis.StringMap(r.Do("HGETALL", key(qid, "meta-"+item)))
+	if err != nil {
+		return nil, err
+	}
+	if len(meta) == 0 {
+		return nil, redis.ErrNil
+	}
+
+	info := &ItemInfo{
+		Item:      item,
+		State:     meta["state"],
+		Enqueued:  unixTime(meta["enqueued"]),
+		Leased:    unixTime(meta["leased"]),
+		Completed: unixTime(meta["completed"]),
+		Due:       unixTime(meta["due"]),
+		Updated:   unixTime(meta["updated"]),
+	}
+	info.Attempts, err = redis.Int(r.Do("HGET", key(qid, "attempts"), item))
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	info.Priority, err = redis.Int(r.Do("HGET", key(qid, "priority"), item))
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+
+	switch info.State {
+	case StateQueued:
+		position, err := queuedPosition(r, qid, item, info.Priority)
+		if err != nil {
+			return nil, err
+		}
+		if position >= 0 {
+			info.Position = &position
+		}
+	case StatePending:
+		lease := key(qid, "lease-"+meta["token"])
+		info.Leaseholder, err = redis.String(r.Do("GET", lease))
+		if err != nil && err != redis.ErrNil {
+			return nil, err
+		}
+		ttl, err := redis.Int(r.Do("TTL", lease))
+		if err != nil {
+			return nil, err
+		}
+		if ttl >= 0 {
+			info.TTL = &ttl
+		}
+	}
+	return info, nil
+}
+
+// queuedPosition returns how many items are served before a queued item, or
+// -1 if it is not on its list, as when Wait is claiming it.
+func queuedPosition(r redis.Conn, qid, item string, priority int) (int, error) {
+	priorities, err := loadPriorities(r, qid)
+	if err != nil {
+		return 0, err
+	}
+	ahead := 0
+	for _, p := range priorities {
+		if p <= priority {
+			break
+		}
+		n, err := redis.Int(r.Do("LLEN", queuedKey(qid, p)))
+		if err != nil {
+			return 0, err
+		}
+		ahead += n
+	}
+	items, err := redis.Strings(r.Do("LRANGE", queuedKey(qid, priority), 0, -1))
+	if err != nil {
+		return 0, err
+	}
+	for i := len(items) - 1; i >= 0; i-- {
+		if items[i] == item {
+			return ahead + len(items) - 1 - i, nil
+		}
+	}
+	return -1, nil
+}
+
+// unixTime formats unix seconds kept by the scripts, which may be
+// fractional, or returns "" if there are none.
+func unixTime(value string) string {
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return ""
+	}
+	return time.Unix(int64(seconds), 0).UTC().Format(time.RFC3339)
+}
+
+func (info *ItemInfo) String() string {
+	parts := []string{fmt.Sprintf("State: %s.", info.State), fmt.Sprintf("Priority: %d.", info.Priority)}
+	if info.Position != nil {
+		parts = append(parts, fmt.Sprintf("Position: %d.", *info.Position))
+	}
+	if info.Leaseholder != "" {
+		parts = append(parts, fmt.Sprintf("Leaseholder: %s.", info.Leaseholder))
+	}
+	if info.TTL != nil {
+		parts = append(parts, fmt.Sprintf("TTL: %d.", *info.TTL))
+	}
+	parts = append(parts, fmt.Sprintf("Attempts: %d.", info.Attempts))
+	for _, field := range []struct{ name, value string }{
+		{"Enqueued", info.Enqueued},
+		{"Leased", info.Leased},
+		{"Completed", info.Completed},
+		{"Due", info.Due},
+	} {
+		if field.value != "" {
+			parts = append(parts, fmt.Sprintf("%s: %s.", field.name, field.value))
+		}
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,140 @@
+package store
+
+import (
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"log"
+	"strings"
+)
+
+// ErrOldKeys is returned by NewRedis when queues are kept in the key layout
+// of older versions, "queues-<qid>-<name>", which MigrateKeys moves.
+var ErrOldKeys = errors.New("queues are kept in the old key layout")
+
+// keyPrefixes start the names of the keys a queue has per priority, lease,
+// item or idempotency key, besides the fixed keys in queueKeyNames. "item-"
+// keys were the leases of versions before tokens.
+var keyPrefixes = []string{"queued-", "lease-", "meta-", "idempotency-", "item-"}
+
+func isKeyName(name string) bool {
+	for _, n := range queueKeyNames {
+		if name == n {
+			return true
+		}
+	}
+	for _, prefix := range keyPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasOldKeys tells whether a queue has any of its main keys in the old
+// layout.
+func hasOldKeys(r redis.Conn, qid string) (bool, error) {
+	names := []string{"settings", "queued", "pending", "scheduled", "done", "dead", "present"}
+	for _, name := range names {
+		r.Send("EXISTS", "queues-"+qid+"-"+name)
+	}
+	if err := r.Flush(); err != nil {
+		return false, err
+	}
+	old := false
+	for range names {
+		exists, err := redis.Bool(r.Receive())
+		if err != nil {
+			return false, err
+		}
+		old = old || exists
+	}
+	return old, nil
+}
+
+// MigrateKeys renames the keys of every registered queue from the old
+// layout to "queues-{<qid>}-<name>". Leases and idempotency keys keep their
+// TTL. A key whose new name is taken already is left alone and logged.
+// Returns the number of keys renamed.
+//
+// Keys in the old layout of one queue may live in different hash slots, so
+// this is meant to run against the Redis holding them before they move to
+// Redis Cluster, with the servers of older versions stopped. It may be run
+// again if it fails halfway.
+func MigrateKeys(r redis.Conn) (int, error) {
+	qids, err := redis.Strings(r.Do("SMEMBERS", "queues"))
+	if err != nil {
+		return 0, err
+	}
+	registered := make(map[string]bool)
+	for _, qid := range qids {
+		registered[qid] = true
+	}
+
+	moved := 0
+	cursor := "0"
+	for {
+		values, err := redis.Values(r.Do("SCAN", cursor, "MATCH", "queues-*", "COUNT", 1000))
+		if err != nil {
+			return moved, err
+		}
+		if cursor, err = redis.String(values[0], nil); err != nil {
+			return moved, err
+		}
+		keys, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return moved, err
+		}
+
+		for _, old := range keys {
+			qid, name, ok := parseOldKey(registered, old)
+			if !ok {
+				continue
+			}
+			renamed, err := redis.Bool(r.Do("RENAMENX", old, key(qid, name)))
+			if isNoSuchKey(err) {
+				// It expired since the scan.
+				continue
+			}
+			if err != nil {
+				return moved, err
+			}
+			if !renamed {
+				log.Printf("Leaving %v, %v exists already", old, key(qid, name))
+				continue
+			}
+			moved++
+		}
+		if cursor == "0" {
+			return moved, nil
+		}
+	}
+}
+
+// parseOldKey returns the queue and name of a key in the old layout, or
+// false if it is not one. Keys already in the new layout are not. A key
+// that could belong to several queues, as "queues-a-b-done" to both "a" and
+// "a-b", goes to the queue with the longest qid.
+func parseOldKey(qids map[string]bool, k string) (string, string, bool) {
+	rest := strings.TrimPrefix(k, "queues-")
+	if strings.HasPrefix(rest, "{") {
+		for i := 1; i+1 < len(rest); i++ {
+			if rest[i:i+2] == "}-" && qids[rest[1:i]] && isKeyName(rest[i+2:]) {
+				return "", "", false
+			}
+		}
+	}
+
+	var qid, name string
+	found := false
+	for i := 0; i < len(rest); i++ {
+		if rest[i] == '-' && qids[rest[:i]] && isKeyName(rest[i+1:]) {
+			qid, name, found = rest[:i], rest[i+1:], true
+		}
+	}
+	return qid, name, found
+}
+
+func isNoSuchKey(err error) bool {
+	e, ok := err.(redis.Error)
+	return ok && strings.Contains(string(e), "no such key")
+}
@@ -0,0 +1,1277 @@
+package store
+
+import (
+	"container/heap"
+	"container/list"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Memory keeps queues in the memory of the process, for development and
+// tests. It follows the Redis scripts step by step so that both behave
+// alike, but queues are lost when the process exits and are not shared
+// between replicas.
+//
+// Every change is made by applying an op, which carries the time and the
+// random seed it is made with so that File can log it and apply it again.
+type Memory struct {
+	mu          sync.Mutex
+	queues      map[string]*memoryQueue
+	idempotency map[string]map[string]*memoryResponse
+	leader      string
+	leaderUntil time.Time
+	rng         *rand.Rand
+	// arrived is closed and replaced whenever items are queued, waking up
+	// Wait.
+	arrived chan struct{}
+	// journal, if set, records an op before it is applied. The op is not
+	// applied if it fails.
+	journal func(op *memoryOp) error
+}
+
+// memoryQueue holds what the "queues-{<qid>}-" keys hold in Redis. The
+// copies of scheduled items are keyed by the members they have there.
+type memoryQueue struct {
+	settings Settings
+	// queued holds a list per priority, from the head, served next, to the
+	// tail. priorities are the priorities other than 0 in use.
+	queued     map[int]*list.List
+	priorities map[int]bool
+	priority   map[string]int
+	pending    map[string]*memoryLease
+	delivered  map[string]string
+	leases     int
+	attempts   map[string]int
+	done       []string
+	dead       []string
+	scheduled  map[string]float64
+	payloads   map[string]string
+	present    map[string]int
+	recent     map[string]int64
+	meta       map[string]*memoryMeta
+	// deadlines orders the pending tokens by deadline, dues the scheduled
+	// members by due time and completions the recent items by completion
+	// time, as the sorted sets do in Redis, so that reaping only touches
+	// what has run out.
+	deadlines   *timeIndex
+	dues        *timeIndex
+	completions *timeIndex
+}
+
+// memoryLease is a pending lease. The deadline decides when the reaper
+// requeues it, and the lease itself runs until expires. Expire ends both.
+type memoryLease struct {
+	ip       string
+	deadline int64
+	expires  time.Time
+}
+
+// memoryMeta is the metadata of an item. Times are unix seconds, 0 if not
+// set.
+type memoryMeta struct {
+	state     string
+	updated   int64
+	enqueued  int64
+	leased    int64
+	completed int64
+	due       float64
+	token     string
+}
+
+type memoryResponse struct {
+	response []byte
+	expires  time.Time
+}
+
+// Ops changing a Memory store.
+const (
+	opCreate   = "create"
+	opDelete   = "delete"
+	opSettings = "settings"
+	opEnqueue  = "enqueue"
+	opBulk     = "bulk"
+	opNext     = "next"
+	opDone     = "done"
+	opExtend   = "extend"
+	opExpire   = "expire"
+	opRelease  = "release"
+	opRedrive  = "redrive"
+	opRemove   = "remove"
+	opReap     = "reap"
+	opClaim    = "claim"
+	opSave     = "save"
+	opForget   = "forget"
+)
+
+// memoryOp is a change to a Memory store, with the arguments its op needs.
+// Now is in unix nanoseconds. Seq numbers the ops in the log of a File
+// store. The payload of an enqueued entry is kept apart as bytes, since
+// JSON strings cannot hold a payload that is not UTF-8.
+type memoryOp struct {
+	Seq      int64     `json:"seq"`
+	Op       string    `json:"op"`
+	Qid      string    `json:"qid,omitempty"`
+	Now      int64     `json:"now"`
+	Seed     int64     `json:"seed"`
+	Settings *Settings `json:"settings,omitempty"`
+	Entry    *Entry    `json:"entry,omitempty"`
+	Payload  []byte    `json:"payload,omitempty"`
+	Items    []string  `json:"items,omitempty"`
+	Leases   []Lease   `json:"leases,omitempty"`
+	Priority int       `json:"priority,omitempty"`
+	Due      int64     `json:"due,omitempty"`
+	Clear    bool      `json:"clear,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+	Seconds  int       `json:"seconds,omitempty"`
+	Count    int       `json:"count,omitempty"`
+	Item     string    `json:"item,omitempty"`
+	Token    string    `json:"token,omitempty"`
+	Head     bool      `json:"head,omitempty"`
+	Where    string    `json:"where,omitempty"`
+	Name     string    `json:"name,omitempty"`
+	Response []byte    `json:"response,omitempty"`
+	Window   int       `json:"window,omitempty"`
+}
+
+// memoryResult is the outcome of an op.
+type memoryResult struct {
+	status   string
+	statuses []string
+	items    []string
+	dead     []string
+	leases   []Lease
+	n        int
+	ok       bool
+	response []byte
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		queues:      make(map[string]*memoryQueue),
+		idempotency: make(map[string]map[string]*memoryResponse),
+		rng:         rand.New(rand.NewSource(1)),
+		arrived:     make(chan struct{}),
+	}
+}
+
+func newMemoryQueue(settings Settings) *memoryQueue {
+	return &memoryQueue{
+		settings:    settings,
+		queued:      make(map[int]*list.List),
+		priorities:  make(map[int]bool),
+		priority:    make(map[string]int),
+		pending:     make(map[string]*memoryLease),
+		delivered:   make(map[string]string),
+		attempts:    make(map[string]int),
+		scheduled:   make(map[string]float64),
+		payloads:    make(map[string]string),
+		present:     make(map[string]int),
+		recent:      make(map[string]int64),
+		meta:        make(map[string]*memoryMeta),
+		deadlines:   newTimeIndex(),
+		dues:        newTimeIndex(),
+		completions: newTimeIndex(),
+	}
+}
+
+// queue returns a queue, or an empty queue that is not kept if there is no
+// such queue so that changes to it are lost, as they would be in Redis.
+func (s *Memory) queue(qid string) *memoryQueue {
+	if q, ok := s.queues[qid]; ok {
+		return q
+	}
+	return newMemoryQueue(DefaultSettings)
+}
+
+// notify wakes up Wait after items were queued.
+func (s *Memory) notify() {
+	close(s.arrived)
+	s.arrived = make(chan struct{})
+}
+
+// commit stamps an op with the time and a random seed, journals it and
+// applies it. The lock must be held.
+func (s *Memory) commit(op *memoryOp) (memoryResult, error) {
+	op.Now = time.Now().UnixNano()
+	op.Seed = rand.Int63()
+	if s.journal != nil {
+		if err := s.journal(op); err != nil {
+			return memoryResult{}, err
+		}
+	}
+	return s.apply(op), nil
+}
+
+// apply makes the change of an op. Given the same state, the same op makes
+// the same change.
+func (s *Memory) apply(op *memoryOp) memoryResult {
+	now := time.Unix(0, op.Now)
+	unix := now.Unix()
+	s.rng.Seed(op.Seed)
+	q := s.queue(op.Qid)
+	var result memoryResult
+	switch op.Op {
+	case opCreate:
+		s.queues[op.Qid] = newMemoryQueue(*op.Settings)
+	case opDelete:
+		delete(s.queues, op.Qid)
+		delete(s.idempotency, op.Qid)
+	case opSettings:
+		q.settings = *op.Settings
+	case opEnqueue:
+		if _, ok := s.queues[op.Qid]; !ok {
+			result.status = StatusMissing
+			break
+		}
+		entry := *op.Entry
+		entry.Payload = string(op.Payload)
+		result.status = q.enqueue(entry, unix)
+		s.notify()
+	case opBulk:
+		result.status, result.items = s.bulk(op.Qid, op.Items, op.Priority, op.Due, op.Clear, unix)
+		s.notify()
+	case opNext:
+		result.leases = q.next(op.IP, op.Seconds, op.Count, now, s.rng)
+	case opDone:
+		result.statuses = q.complete(op.Leases, now)
+	case opExtend:
+		result.statuses = q.extend(op.Leases, op.Seconds, now)
+	case opExpire:
+		result.ok = q.expire(op.Item, op.Token, now)
+	case opRelease:
+		result.status = q.release(op.Item, op.Token, op.Head, op.Due, now, s.rng)
+		s.notify()
+	case opRedrive:
+		result.n = q.redrive(unix)
+		s.notify()
+	case opRemove:
+		result.n = q.remove(op.Where, op.Items)
+	case opReap:
+		result.items, result.dead = q.reap(unix, s.rng)
+		s.notify()
+	case opClaim:
+		result.response, result.ok = s.claim(op.Qid, op.Name, op.Window, now)
+	case opSave:
+		if saved, ok := s.idempotency[op.Qid][op.Name]; ok && now.Before(saved.expires) {
+			saved.response, saved.expires = op.Response, now.Add(time.Duration(op.Window)*time.Second)
+		}
+	case opForget:
+		delete(s.idempotency[op.Qid], op.Name)
+	}
+	return result
+}
+
+func (s *Memory) Close() error {
+	return nil
+}
+
+func (s *Memory) Queues() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	qids := make([]string, 0, len(s.queues))
+	for qid := range s.queues {
+		qids = append(qids, qid)
+	}
+	sort.Strings(qids)
+	return qids, nil
+}
+
+func (s *Memory) Exists(qid string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.queues[qid]
+	return ok, nil
+}
+
+func (s *Memory) CreateQueue(qid string, settings Settings) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.queues[qid]; ok {
+		return false, nil
+	}
+	_, err := s.commit(&memoryOp{Op: opCreate, Qid: qid, Settings: &settings})
+	return err == nil, err
+}
+
+func (s *Memory) DeleteQueue(qid string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.queues[qid]; !ok {
+		return false, nil
+	}
+	_, err := s.commit(&memoryOp{Op: opDelete, Qid: qid})
+	return err == nil, err
+}
+
+func (s *Memory) Settings(qid string) (Settings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queue(qid).settings, nil
+}
+
+func (s *Memory) SaveSettings(qid string, settings Settings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.commit(&memoryOp{Op: opSettings, Qid: qid, Settings: &settings})
+	return err
+}
+
+func (s *Memory) Enqueue(qid string, entry Entry) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payload := []byte(entry.Payload)
+	entry.Payload = ""
+	result, err := s.commit(&memoryOp{Op: opEnqueue, Qid: qid, Entry: &entry, Payload: payload})
+	return result.status, err
+}
+
+func (s *Memory) Bulk(qid string, items []string, priority int, due int64, clear bool) (string, []string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, err := s.commit(&memoryOp{Op: opBulk, Qid: qid, Items: items, Priority: priority, Due: due,
+		Clear: clear})
+	return result.status, result.items, err
+}
+
+func (s *Memory) bulk(qid string, items []string, priority int, due int64, clear bool, now int64) (string, []string) {
+	q, exists := s.queues[qid]
+	if !exists {
+		q = newMemoryQueue(DefaultSettings)
+	}
+	clear = clear && exists
+
+	mode := q.settings.Dedupe
+	seen := make(map[string]bool)
+	var fresh, duplicates []string
+	for _, item := range items {
+		if mode != DedupeOff && (seen[item] || !clear && q.held(item, now)) {
+			duplicates = append(duplicates, item)
+		} else {
+			seen[item] = true
+			fresh = append(fresh, item)
+		}
+	}
+	if mode == DedupeReject && len(duplicates) > 0 {
+		return StatusDuplicate, duplicates
+	}
+
+	if clear {
+		q.clear()
+	}
+	s.queues[qid] = q
+	for _, item := range fresh {
+		q.setPriority(item, priority)
+		q.add(item, due, now)
+	}
+	return StatusOK, duplicates
+}
+
+func (s *Memory) Next(qid, ip string, seconds, count int) ([]Lease, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.next(qid, ip, seconds, count)
+}
+
+// next leases items if any are queued. The lock must be held.
+func (s *Memory) next(qid, ip string, seconds, count int) ([]Lease, error) {
+	if s.queue(qid).queuedLen() == 0 {
+		return nil, nil
+	}
+	result, err := s.commit(&memoryOp{Op: opNext, Qid: qid, IP: ip, Seconds: seconds, Count: count})
+	return result.leases, err
+}
+
+// Wait tries again whenever items are queued in any queue. Unlike Redis it
+// serves every priority, in the queue's order.
+func (s *Memory) Wait(qid, ip string, seconds int, wait time.Duration, cancel <-chan bool) ([]Lease, error) {
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	for {
+		s.mu.Lock()
+		leases, err := s.next(qid, ip, seconds, 1)
+		arrived := s.arrived
+		s.mu.Unlock()
+		if err != nil || len(leases) > 0 {
+			return leases, err
+		}
+
+		select {
+		case <-arrived:
+		case <-timeout.C:
+			return nil, nil
+		case <-cancel:
+			return nil, nil
+		}
+	}
+}
+
+func (s *Memory) Done(qid string, leases []Lease) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, err := s.commit(&memoryOp{Op: opDone, Qid: qid, Leases: leases})
+	return result.statuses, err
+}
+
+func (s *Memory) Extend(qid string, seconds int, leases []Lease) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, err := s.commit(&memoryOp{Op: opExtend, Qid: qid, Seconds: seconds, Leases: leases})
+	return result.statuses, err
+}
+
+func (s *Memory) TTL(qid, item, token string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.queue(qid)
+	now := time.Now()
+	switch q.leaseStatus(item, token, now) {
+	case StatusConflict:
+		return 0, ErrConflict
+	case StatusOK:
+		return q.pending[token].ttl(now), nil
+	}
+	return -2, nil
+}
+
+func (s *Memory) Expire(qid, item, token string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch s.queue(qid).leaseStatus(item, token, time.Now()) {
+	case StatusConflict:
+		return false, ErrConflict
+	case StatusOK:
+		result, err := s.commit(&memoryOp{Op: opExpire, Qid: qid, Item: item, Token: token})
+		return result.ok, err
+	}
+	return false, nil
+}
+
+func (s *Memory) Release(qid, item, token string, head bool, due int64) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status := s.queue(qid).leaseStatus(item, token, time.Now()); status != StatusOK {
+		return status, nil
+	}
+	result, err := s.commit(&memoryOp{Op: opRelease, Qid: qid, Item: item, Token: token, Head: head, Due: due})
+	return result.status, err
+}
+
+func (s *Memory) Redrive(qid string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, err := s.commit(&memoryOp{Op: opRedrive, Qid: qid})
+	return result.n, err
+}
+
+func (s *Memory) Remove(qid, where string, items []string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, err := s.commit(&memoryOp{Op: opRemove, Qid: qid, Where: where, Items: items})
+	return result.n, err
+}
+
+// Purge removes the items that match in one op, as Remove does.
+func (s *Memory) Purge(qid, where string, match func(string) bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.queue(qid)
+	var candidates []string
+	if where != RemoveScheduled {
+		candidates = append(candidates, q.listQueued()...)
+	}
+	if where != RemoveQueued {
+		candidates = append(candidates, q.sortedScheduled()...)
+	}
+
+	seen := make(map[string]bool)
+	var matched []string
+	for _, item := range candidates {
+		if !seen[item] && match(item) {
+			matched = append(matched, item)
+		}
+		seen[item] = true
+	}
+	result, err := s.commit(&memoryOp{Op: opRemove, Qid: qid, Where: where, Items: matched})
+	return result.n, err
+}
+
+// Lead keeps the leader in memory only: a single process always leads.
+func (s *Memory) Lead(holder string, lease time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.leader != holder && s.leader != "" && now.Before(s.leaderUntil) {
+		return false, nil
+	}
+	s.leader, s.leaderUntil = holder, now.Add(lease)
+	return true, nil
+}
+
+// Reap also drops the expired idempotency keys of the queue. It only makes
+// an op if there is something to reap.
+func (s *Memory) Reap(qid string) ([]string, []string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for name, saved := range s.idempotency[qid] {
+		if !now.Before(saved.expires) {
+			delete(s.idempotency[qid], name)
+		}
+	}
+	if len(s.idempotency[qid]) == 0 {
+		delete(s.idempotency, qid)
+	}
+
+	if q, ok := s.queues[qid]; !ok || !q.reapable(now.Unix()) {
+		return nil, nil, nil
+	}
+	result, err := s.commit(&memoryOp{Op: opReap, Qid: qid})
+	return result.items, result.dead, err
+}
+
+func (s *Memory) Stats(qid string) (Stats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.queue(qid)
+	stats := Stats{Done: len(q.done), Pending: len(q.pending), Dead: len(q.dead)}
+	for _, priority := range q.sortedPriorities() {
+		n := q.list(priority).Len()
+		stats.Queued += n
+		stats.ByPriority = append(stats.ByPriority, PriorityCount{priority, n})
+	}
+	return stats, nil
+}
+
+func (s *Memory) List(qid, state string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.queue(qid)
+	switch state {
+	case StateQueued:
+		return q.listQueued(), nil
+	case StateDone:
+		return append([]string(nil), q.done...), nil
+	case StateDead:
+		return append([]string(nil), q.dead...), nil
+	}
+	return nil, nil
+}
+
+func (s *Memory) Pending(qid string) ([]PendingItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.queue(qid)
+	now := time.Now()
+	tokens := q.sortedPending()
+	pending := make([]PendingItem, 0, len(tokens))
+	for _, token := range tokens {
+		lease := q.pending[token]
+		item := PendingItem{Item: tokenItem(token), TTL: -2}
+		if lease.alive(now) {
+			item.IP, item.TTL = lease.ip, lease.ttl(now)
+		}
+		pending = append(pending, item)
+	}
+	return pending, nil
+}
+
+func (s *Memory) Scheduled(qid string) ([]ScheduledItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.queue(qid)
+	members := q.sortedScheduled()
+	scheduled := make([]ScheduledItem, 0, len(members))
+	for _, member := range members {
+		due := time.Unix(int64(q.scheduled[member]), 0)
+		scheduled = append(scheduled, ScheduledItem{scheduledItem(member), due})
+	}
+	return scheduled, nil
+}
+
+func (s *Memory) Item(qid, item string) (*ItemInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.queue(qid)
+	meta, ok := q.meta[item]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	info := &ItemInfo{
+		Item:      item,
+		State:     meta.state,
+		Priority:  q.priority[item],
+		Attempts:  q.attempts[item],
+		Enqueued:  memoryTime(float64(meta.enqueued)),
+		Leased:    memoryTime(float64(meta.leased)),
+		Completed: memoryTime(float64(meta.completed)),
+		Due:       memoryTime(meta.due),
+		Updated:   memoryTime(float64(meta.updated)),
+	}
+	switch info.State {
+	case StateQueued:
+		if position := q.position(item); position >= 0 {
+			info.Position = &position
+		}
+	case StatePending:
+		now := time.Now()
+		if lease, ok := q.pending[meta.token]; ok && lease.alive(now) {
+			ttl := lease.ttl(now)
+			info.Leaseholder, info.TTL = lease.ip, &ttl
+		}
+	}
+	return info, nil
+}
+
+// memoryTime formats unix seconds as unixTime does, or returns "" for 0.
+func memoryTime(seconds float64) string {
+	if seconds == 0 {
+		return ""
+	}
+	return time.Unix(int64(seconds), 0).UTC().Format(time.RFC3339)
+}
+
+func (s *Memory) ClaimIdempotencyKey(qid, name string, window int) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if saved, ok := s.idempotency[qid][name]; ok && time.Now().Before(saved.expires) {
+		return saved.response, false, nil
+	}
+	result, err := s.commit(&memoryOp{Op: opClaim, Qid: qid, Name: name, Window: window})
+	return result.response, result.ok, err
+}
+
+// claim marks a key as in progress unless it is held.
+func (s *Memory) claim(qid, name string, window int, now time.Time) ([]byte, bool) {
+	if saved, ok := s.idempotency[qid][name]; ok && now.Before(saved.expires) {
+		return saved.response, false
+	}
+	if s.idempotency[qid] == nil {
+		s.idempotency[qid] = make(map[string]*memoryResponse)
+	}
+	s.idempotency[qid][name] = &memoryResponse{expires: now.Add(time.Duration(window) * time.Second)}
+	return nil, true
+}
+
+func (s *Memory) SaveIdempotencyKey(qid, name string, response []byte, window int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.commit(&memoryOp{Op: opSave, Qid: qid, Name: name, Response: response, Window: window})
+	return err
+}
+
+func (s *Memory) ForgetIdempotencyKey(qid, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.commit(&memoryOp{Op: opForget, Qid: qid, Name: name})
+	return err
+}
+
+func (q *memoryQueue) enqueue(entry Entry, now int64) string {
+	if mode := q.settings.Dedupe; mode != DedupeOff && q.held(entry.Item, now) {
+		if mode == DedupeReject {
+			return StatusDuplicate
+		}
+		return StatusIgnored
+	}
+	q.setPriority(entry.Item, entry.Priority)
+	if entry.Payload != "" {
+		q.payloads[entry.Item] = entry.Payload
+	}
+	q.add(entry.Item, entry.Due, now)
+	return StatusOK
+}
+
+func (q *memoryQueue) next(ip string, seconds, count int, now time.Time, rng *rand.Rand) []Lease {
+	var leases []Lease
+	for len(leases) < count {
+		item, ok := q.pop(rng)
+		if !ok {
+			break
+		}
+		token := q.grantLease(item, ip, seconds, now)
+		leases = append(leases, Lease{item, token, q.payloads[item]})
+	}
+	return leases
+}
+
+// complete moves leased items to done.
+func (q *memoryQueue) complete(leases []Lease, now time.Time) []string {
+	statuses := make([]string, 0, len(leases))
+	for _, lease := range leases {
+		status := q.leaseStatus(lease.Item, lease.Token, now)
+		if status == StatusOK {
+			q.dropLease(lease.Token)
+			if q.leave(lease.Item, now.Unix()) {
+				q.forget(lease.Item)
+			}
+			q.setState(lease.Item, StateDone, now.Unix()).completed = now.Unix()
+			q.done = append(q.done, lease.Item)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func (q *memoryQueue) extend(leases []Lease, seconds int, now time.Time) []string {
+	statuses := make([]string, 0, len(leases))
+	for _, lease := range leases {
+		status := q.leaseStatus(lease.Item, lease.Token, now)
+		if status == StatusOK {
+			q.renewLease(lease.Token, now, seconds)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func (q *memoryQueue) expire(item, token string, now time.Time) bool {
+	if q.leaseStatus(item, token, now) != StatusOK {
+		return false
+	}
+	lease := q.pending[token]
+	lease.deadline, lease.expires = 0, time.Time{}
+	q.deadlines.set(token, 0)
+	return true
+}
+
+func (q *memoryQueue) release(item, token string, head bool, due int64, now time.Time, rng *rand.Rand) string {
+	status := q.leaseStatus(item, token, now)
+	if status != StatusOK {
+		return status
+	}
+	q.dropLease(token)
+
+	unix := now.Unix()
+	at := float64(due)
+	if due == 0 {
+		if delay := q.backoff(item, rng); delay > 0 {
+			at = float64(unix) + delay
+		}
+	}
+	switch {
+	case q.exhausted(item):
+		q.kill(item, unix)
+	case at > 0:
+		q.schedule(item, at, unix)
+	default:
+		q.setState(item, StateQueued, unix)
+		q.push(item, head)
+	}
+	return status
+}
+
+func (q *memoryQueue) redrive(now int64) int {
+	n := len(q.dead)
+	for _, item := range q.dead {
+		delete(q.attempts, item)
+		q.arrive(item)
+		q.setState(item, StateQueued, now).completed = 0
+		q.append(item)
+	}
+	q.dead = nil
+	return n
+}
+
+// reapable tells whether a lease has run out or a scheduled item is due.
+func (q *memoryQueue) reapable(now int64) bool {
+	if _, deadline, ok := q.deadlines.first(); ok && deadline <= float64(now) {
+		return true
+	}
+	_, due, ok := q.dues.first()
+	return ok && due <= float64(now)
+}
+
+// reap gives expired leases back to the queue and queues scheduled items
+// that are due. Returns the items requeued and the items moved to dead.
+func (q *memoryQueue) reap(now int64, rng *rand.Rand) ([]string, []string) {
+	var requeued, dead []string
+	for {
+		token, deadline, ok := q.deadlines.first()
+		if !ok || deadline > float64(now) {
+			break
+		}
+		item := tokenItem(token)
+		q.dropLease(token)
+		delay := q.backoff(item, rng)
+		switch {
+		case q.exhausted(item):
+			q.kill(item, now)
+			dead = append(dead, item)
+		case delay > 0:
+			q.schedule(item, float64(now)+delay, now)
+			requeued = append(requeued, item)
+		default:
+			q.setState(item, StateQueued, now)
+			q.push(item, true)
+			requeued = append(requeued, item)
+		}
+	}
+	for {
+		member, due, ok := q.dues.first()
+		if !ok || due > float64(now) {
+			break
+		}
+		q.unschedule(member)
+		item := scheduledItem(member)
+		q.setState(item, StateQueued, now)
+		q.append(item)
+	}
+	return requeued, dead
+}
+
+// clear empties a queue, keeping its settings.
+func (q *memoryQueue) clear() {
+	*q = *newMemoryQueue(q.settings)
+}
+
+// add counts a new item in and queues or schedules it.
+func (q *memoryQueue) add(item string, due, now int64) {
+	q.arrive(item)
+	q.setEnqueued(item, now, due)
+	if due > 0 {
+		q.scheduleCopy(item, float64(due))
+	} else {
+		q.append(item)
+	}
+}
+
+func (q *memoryQueue) list(priority int) *list.List {
+	l, ok := q.queued[priority]
+	if !ok {
+		l = list.New()
+		q.queued[priority] = l
+	}
+	return l
+}
+
+func (q *memoryQueue) queuedLen() int {
+	n := 0
+	for _, l := range q.queued {
+		n += l.Len()
+	}
+	return n
+}
+
+// sortedPriorities returns the priorities in use, highest first, always
+// with 0.
+func (q *memoryQueue) sortedPriorities() []int {
+	priorities := []int{0}
+	for priority := range q.priorities {
+		priorities = append(priorities, priority)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(priorities)))
+	return priorities
+}
+
+// listQueued returns the queued items as List does.
+func (q *memoryQueue) listQueued() []string {
+	var items []string
+	for _, priority := range q.sortedPriorities() {
+		for e := q.list(priority).Back(); e != nil; e = e.Prev() {
+			items = append(items, e.Value.(string))
+		}
+	}
+	return items
+}
+
+// position returns how many items are served before a queued item, or -1
+// if it is not queued.
+func (q *memoryQueue) position(item string) int {
+	priority := q.priority[item]
+	ahead := 0
+	for _, p := range q.sortedPriorities() {
+		if p <= priority {
+			break
+		}
+		ahead += q.list(p).Len()
+	}
+	for e := q.list(priority).Front(); e != nil; e = e.Next() {
+		if e.Value.(string) == item {
+			return ahead
+		}
+		ahead++
+	}
+	return -1
+}
+
+// sortedPending returns the pending lease tokens by deadline.
+func (q *memoryQueue) sortedPending() []string {
+	tokens := make([]string, 0, len(q.pending))
+	for token := range q.pending {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		a, b := q.pending[tokens[i]].deadline, q.pending[tokens[j]].deadline
+		return a < b || a == b && tokens[i] < tokens[j]
+	})
+	return tokens
+}
+
+// sortedScheduled returns the members of the scheduled items, soonest
+// first.
+func (q *memoryQueue) sortedScheduled() []string {
+	items := make([]string, 0, len(q.scheduled))
+	for item := range q.scheduled {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		a, b := q.scheduled[items[i]], q.scheduled[items[j]]
+		return a < b || a == b && items[i] < items[j]
+	})
+	return items
+}
+
+// push puts an item on the list of its priority, either at the head so it
+// is served next or at the tail.
+func (q *memoryQueue) push(item string, head bool) {
+	priority := q.priority[item]
+	if priority != 0 {
+		q.priorities[priority] = true
+	}
+	if head {
+		q.list(priority).PushFront(item)
+	} else {
+		q.list(priority).PushBack(item)
+	}
+}
+
+// append puts a new item on the queue where the queue's order wants it.
+func (q *memoryQueue) append(item string) {
+	q.push(item, q.settings.Order == OrderLIFO)
+}
+
+// pop takes the next item of the highest priority.
+func (q *memoryQueue) pop(rng *rand.Rand) (string, bool) {
+	for _, priority := range q.sortedPriorities() {
+		l := q.list(priority)
+		if l.Len() > 0 {
+			e := l.Front()
+			if q.settings.Order == OrderRandom {
+				for i := rng.Intn(l.Len()); i > 0; i-- {
+					e = e.Next()
+				}
+			}
+			return l.Remove(e).(string), true
+		}
+		delete(q.priorities, priority)
+	}
+	return "", false
+}
+
+// remove takes every copy of items off the queued lists, the scheduled
+// items or both. Returns the number of copies removed.
+func (q *memoryQueue) remove(where string, items []string) int {
+	unscheduled := make(map[string]int)
+	if where != RemoveQueued {
+		for _, item := range items {
+			unscheduled[item] = 0
+		}
+		for member := range q.scheduled {
+			item := scheduledItem(member)
+			if _, ok := unscheduled[item]; ok {
+				q.unschedule(member)
+				unscheduled[item]++
+			}
+		}
+	}
+	removed := 0
+	for _, item := range items {
+		n := 0
+		if where != RemoveScheduled {
+			l := q.list(q.priority[item])
+			for e := l.Front(); e != nil; {
+				next := e.Next()
+				if e.Value.(string) == item {
+					l.Remove(e)
+					n++
+				}
+				e = next
+			}
+		}
+		if where != RemoveQueued {
+			n += unscheduled[item]
+			unscheduled[item] = 0
+		}
+		for i := 0; i < n; i++ {
+			if q.leave(item, 0) {
+				q.forget(item)
+				delete(q.meta, item)
+			}
+		}
+		removed += n
+	}
+	return removed
+}
+
+// setPriority records the priority of an item about to be enqueued.
+func (q *memoryQueue) setPriority(item string, priority int) {
+	if priority == 0 {
+		delete(q.priority, item)
+	} else {
+		q.priority[item] = priority
+	}
+}
+
+// setState records the state of an item and returns its metadata for the
+// caller to fill in.
+func (q *memoryQueue) setState(item, state string, now int64) *memoryMeta {
+	meta, ok := q.meta[item]
+	if !ok {
+		meta = &memoryMeta{}
+		q.meta[item] = meta
+	}
+	meta.state, meta.updated = state, now
+	if state != StatePending {
+		meta.token = ""
+	}
+	if state != StateScheduled {
+		meta.due = 0
+	}
+	return meta
+}
+
+// setEnqueued starts the metadata of an item entering the queue afresh.
+func (q *memoryQueue) setEnqueued(item string, now, due int64) {
+	delete(q.meta, item)
+	if due > 0 {
+		meta := q.setState(item, StateScheduled, now)
+		meta.enqueued, meta.due = now, float64(due)
+	} else {
+		q.setState(item, StateQueued, now).enqueued = now
+	}
+}
+
+// schedule puts an item given back to the queue on the scheduled items.
+func (q *memoryQueue) schedule(item string, due float64, now int64) {
+	q.setState(item, StateScheduled, now).due = due
+	q.scheduleCopy(item, due)
+}
+
+// scheduleCopy puts a copy of an item on the scheduled items under a member
+// of its own, as schedule in scheduledLua does.
+func (q *memoryQueue) scheduleCopy(item string, due float64) {
+	member := item
+	for n := 1; ; n++ {
+		if _, ok := q.scheduled[member]; !ok {
+			break
+		}
+		member = item + "\n" + strconv.Itoa(n)
+	}
+	q.scheduled[member] = due
+	q.dues.set(member, due)
+}
+
+// unschedule takes a member off the scheduled items.
+func (q *memoryQueue) unschedule(member string) {
+	delete(q.scheduled, member)
+	q.dues.remove(member)
+}
+
+// kill moves an item out of attempts to the dead list.
+func (q *memoryQueue) kill(item string, now int64) {
+	q.leave(item, 0)
+	q.setState(item, StateDead, now).completed = now
+	q.dead = append(q.dead, item)
+}
+
+// held tells whether an item is queued, scheduled or pending, or was done
+// within the dedupe window.
+func (q *memoryQueue) held(item string, now int64) bool {
+	if _, ok := q.present[item]; ok {
+		return true
+	}
+	if window := int64(q.settings.DedupeWindow); window > 0 {
+		for {
+			recent, at, ok := q.completions.first()
+			if !ok || at > float64(now-window) {
+				break
+			}
+			delete(q.recent, recent)
+			q.completions.remove(recent)
+		}
+		_, ok := q.recent[item]
+		return ok
+	}
+	return false
+}
+
+// arrive counts a copy of an item entering the queue.
+func (q *memoryQueue) arrive(item string) {
+	q.present[item]++
+}
+
+// leave counts a copy of an item leaving the queue, for done at doneAt or
+// for dead if doneAt is 0. Returns true if it was the last copy.
+func (q *memoryQueue) leave(item string, doneAt int64) bool {
+	q.present[item]--
+	last := q.present[item] <= 0
+	if last {
+		delete(q.present, item)
+	}
+	if doneAt > 0 && q.settings.DedupeWindow > 0 {
+		q.recent[item] = doneAt
+		q.completions.set(item, float64(doneAt))
+	}
+	return last
+}
+
+// forget drops the attempt count, priority and payload of an item that left
+// the queue for good.
+func (q *memoryQueue) forget(item string) {
+	delete(q.attempts, item)
+	delete(q.priority, item)
+	delete(q.payloads, item)
+}
+
+// exhausted tells whether an item has used up its attempts.
+func (q *memoryQueue) exhausted(item string) bool {
+	max := q.settings.MaxAttempts
+	return max > 0 && q.attempts[item] >= max
+}
+
+// backoff returns the seconds an item given back to the queue waits before
+// it is queued again.
+func (q *memoryQueue) backoff(item string, rng *rand.Rand) float64 {
+	settings := q.settings
+	if settings.Backoff <= 0 {
+		return 0
+	}
+	n, ok := q.attempts[item]
+	if !ok {
+		n = 1
+	}
+	delay := float64(settings.Backoff) * math.Pow(settings.BackoffFactor, float64(n-1))
+	if settings.BackoffMax > 0 && delay > float64(settings.BackoffMax) {
+		delay = float64(settings.BackoffMax)
+	}
+	return delay * (1 + float64(settings.BackoffJitter)/100*(2*rng.Float64()-1))
+}
+
+// grantLease puts an item on pending under a new lease and returns the
+// lease token.
+func (q *memoryQueue) grantLease(item, ip string, seconds int, now time.Time) string {
+	q.leases++
+	token := item + ":" + strconv.Itoa(q.leases)
+	q.attempts[item]++
+	q.delivered[item] = token
+	q.pending[token] = &memoryLease{ip: ip}
+	q.renewLease(token, now, seconds)
+	meta := q.setState(item, StatePending, now.Unix())
+	meta.leased, meta.token = now.Unix(), token
+	return token
+}
+
+// leaseStatus checks that an item is pending under the given token. Any
+// other token conflicts if the item is leased, and is not pending if it is
+// not.
+func (q *memoryQueue) leaseStatus(item, token string, now time.Time) string {
+	lease, ok := q.pending[token]
+	if tokenItem(token) != item || !ok {
+		if last, ok := q.delivered[item]; ok && last != token {
+			return StatusConflict
+		}
+		return StatusNotPending
+	}
+	if !lease.alive(now) {
+		return StatusLeaseExpired
+	}
+	return StatusOK
+}
+
+// renewLease runs a pending lease for the given seconds from now.
+func (q *memoryQueue) renewLease(token string, now time.Time, seconds int) {
+	lease := q.pending[token]
+	lease.renew(now, seconds)
+	q.deadlines.set(token, float64(lease.deadline))
+}
+
+// dropLease takes a lease off pending.
+func (q *memoryQueue) dropLease(token string) {
+	delete(q.pending, token)
+	q.deadlines.remove(token)
+	item := tokenItem(token)
+	if q.delivered[item] == token {
+		delete(q.delivered, item)
+	}
+}
+
+func (l *memoryLease) renew(now time.Time, seconds int) {
+	l.deadline = now.Unix() + int64(seconds)
+	l.expires = now.Add(time.Duration(seconds) * time.Second)
+}
+
+func (l *memoryLease) alive(now time.Time) bool {
+	return now.Before(l.expires)
+}
+
+// ttl returns the seconds left on the lease, rounded as Redis does.
+func (l *memoryLease) ttl(now time.Time) int {
+	return int((l.expires.Sub(now) + time.Second/2) / time.Second)
+}
+
+// timeIndex is a heap of keys by time, soonest first and by key on ties.
+type timeIndex struct {
+	keys  []string
+	times map[string]float64
+	index map[string]int
+}
+
+func newTimeIndex() *timeIndex {
+	return &timeIndex{times: make(map[string]float64), index: make(map[string]int)}
+}
+
+// set adds a key at the given time or moves it there.
+func (x *timeIndex) set(key string, at float64) {
+	x.times[key] = at
+	if i, ok := x.index[key]; ok {
+		heap.Fix(x, i)
+	} else {
+		heap.Push(x, key)
+	}
+}
+
+func (x *timeIndex) remove(key string) {
+	if i, ok := x.index[key]; ok {
+		heap.Remove(x, i)
+	}
+}
+
+// first returns the soonest key and its time, if any.
+func (x *timeIndex) first() (string, float64, bool) {
+	if len(x.keys) == 0 {
+		return "", 0, false
+	}
+	return x.keys[0], x.times[x.keys[0]], true
+}
+
+func (x *timeIndex) Len() int {
+	return len(x.keys)
+}
+
+func (x *timeIndex) Less(i, j int) bool {
+	a, b := x.times[x.keys[i]], x.times[x.keys[j]]
+	return a < b || a == b && x.keys[i] < x.keys[j]
+}
+
+func (x *timeIndex) Swap(i, j int) {
+	x.keys[i], x.keys[j] = x.keys[j], x.keys[i]
+	x.index[x.keys[i]], x.index[x.keys[j]] = i, j
+}
+
+func (x *timeIndex) Push(key interface{}) {
+	x.index[key.(string)] = len(x.keys)
+	x.keys = append(x.keys, key.(string))
+}
+
+func (x *timeIndex) Pop() interface{} {
+	key := x.keys[len(x.keys)-1]
+	x.keys = x.keys[:len(x.keys)-1]
+	delete(x.times, key)
+	delete(x.index, key)
+	return key
+}
@@ -0,0 +1,358 @@
+package store
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func newMemoryQueueStore(t *testing.T, settings Settings) *Memory {
+	s := NewMemory()
+	if created, err := s.CreateQueue("q", settings); !created || err != nil {
+		t.Fatalf("CreateQueue = %v, %v", created, err)
+	}
+	return s
+}
+
+func enqueue(t *testing.T, s Store, items ...string) {
+	for _, item := range items {
+		if status, err := s.Enqueue("q", Entry{Item: item}); status != StatusOK || err != nil {
+			t.Fatalf("Enqueue(%q) = %v, %v", item, status, err)
+		}
+	}
+}
+
+func next(t *testing.T, s Store, count int) []Lease {
+	leases, err := s.Next("q", "1.2.3.4", 60, count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leases
+}
+
+func leasedItems(leases []Lease) []string {
+	items := make([]string, 0, len(leases))
+	for _, lease := range leases {
+		items = append(items, lease.Item)
+	}
+	return items
+}
+
+func TestMemoryLease(t *testing.T) {
+	s := newMemoryQueueStore(t, DefaultSettings)
+	enqueue(t, s, "a", "b")
+	leases := next(t, s, 1)
+	if len(leases) != 1 || leases[0].Item != "a" || leases[0].Token != "a:1" {
+		t.Fatalf("leased %+v, want a:1", leases)
+	}
+	a := leases[0]
+
+	if ttl, err := s.TTL("q", "a", a.Token); ttl != 60 || err != nil {
+		t.Errorf("TTL = %v, %v, want 60", ttl, err)
+	}
+	if _, err := s.TTL("q", "a", "a:7"); err != ErrConflict {
+		t.Errorf("TTL under another token = %v, want ErrConflict", err)
+	}
+	if ttl, err := s.TTL("q", "b", "b:7"); ttl >= 0 || err != nil {
+		t.Errorf("TTL of a queued item = %v, %v, want no lease", ttl, err)
+	}
+	if statuses, _ := s.Extend("q", 120, []Lease{a}); !reflect.DeepEqual(statuses, []string{StatusOK}) {
+		t.Errorf("Extend = %v", statuses)
+	}
+	if ttl, _ := s.TTL("q", "a", a.Token); ttl != 120 {
+		t.Errorf("TTL after Extend = %v, want 120", ttl)
+	}
+
+	statuses, err := s.Done("q", []Lease{{Item: "a", Token: "a:7"}, {Item: "b", Token: "b:7"}, a, a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{StatusConflict, StatusNotPending, StatusOK, StatusNotPending}
+	if !reflect.DeepEqual(statuses, want) {
+		t.Errorf("Done = %v, want %v", statuses, want)
+	}
+	stats, _ := s.Stats("q")
+	if stats.Done != 1 || stats.Pending != 0 || stats.Queued != 1 {
+		t.Errorf("stats %+v, want 1 done and 1 queued", stats)
+	}
+
+	b := next(t, s, 1)[0]
+	if expired, err := s.Expire("q", "b", b.Token); !expired || err != nil {
+		t.Fatalf("Expire = %v, %v", expired, err)
+	}
+	if statuses, _ := s.Done("q", []Lease{b}); statuses[0] != StatusLeaseExpired {
+		t.Errorf("Done after Expire = %v, want %v", statuses, StatusLeaseExpired)
+	}
+	if status, _ := s.Release("q", "b", b.Token, false, 0); status != StatusLeaseExpired {
+		t.Errorf("Release after Expire = %v, want %v", status, StatusLeaseExpired)
+	}
+}
+
+func TestMemoryRelease(t *testing.T) {
+	s := newMemoryQueueStore(t, DefaultSettings)
+	enqueue(t, s, "a", "b", "c")
+	a := next(t, s, 1)[0]
+	if status, err := s.Release("q", "a", a.Token, true, 0); status != StatusOK || err != nil {
+		t.Fatalf("Release = %v, %v", status, err)
+	}
+	checkQueued(t, s, "q", []string{"c", "b", "a"})
+
+	a = next(t, s, 1)[0]
+	if a.Item != "a" || a.Token != "a:2" {
+		t.Errorf("leased %+v after release to the head, want a:2", a)
+	}
+	s.Release("q", "a", a.Token, false, 0)
+	checkQueued(t, s, "q", []string{"a", "c", "b"})
+}
+
+func TestMemoryReap(t *testing.T) {
+	s := newMemoryQueueStore(t, Settings{Lease: 60, MaxAttempts: 2, BackoffFactor: 2, Order: OrderFIFO,
+		Dedupe: DedupeOff})
+	enqueue(t, s, "a")
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		a := next(t, s, 1)[0]
+		if requeued, dead, _ := s.Reap("q"); requeued != nil || dead != nil {
+			t.Errorf("reaped %v and %v with the lease running", requeued, dead)
+		}
+		s.Expire("q", "a", a.Token)
+		requeued, dead, err := s.Reap("q")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempt == 1 && (!reflect.DeepEqual(requeued, []string{"a"}) || dead != nil) {
+			t.Errorf("reaped %v and %v, want a requeued", requeued, dead)
+		}
+		if attempt == 2 && (requeued != nil || !reflect.DeepEqual(dead, []string{"a"})) {
+			t.Errorf("reaped %v and %v, want a dead", requeued, dead)
+		}
+	}
+	if dead, _ := s.List("q", StateDead); !reflect.DeepEqual(dead, []string{"a"}) {
+		t.Errorf("dead %v, want [a]", dead)
+	}
+	if info, _ := s.Item("q", "a"); info.State != StateDead || info.Attempts != 2 {
+		t.Errorf("item %+v, want dead after 2 attempts", info)
+	}
+
+	if n, _ := s.Redrive("q"); n != 1 {
+		t.Errorf("Redrive = %v, want 1", n)
+	}
+	checkQueued(t, s, "q", []string{"a"})
+}
+
+func TestMemoryReapScheduled(t *testing.T) {
+	s := newMemoryQueueStore(t, Settings{Lease: 60, Backoff: 600, BackoffFactor: 2, Order: OrderFIFO,
+		Dedupe: DedupeOff})
+	now := time.Now().Unix()
+	s.Enqueue("q", Entry{Item: "due", Due: now - 1})
+	s.Enqueue("q", Entry{Item: "later", Due: now + 600})
+	requeued, _, err := s.Reap("q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requeued != nil {
+		t.Errorf("requeued %v, want only leases counted", requeued)
+	}
+	checkQueued(t, s, "q", []string{"due"})
+
+	// An expired lease waits out the backoff.
+	lease := next(t, s, 1)[0]
+	s.Expire("q", lease.Item, lease.Token)
+	if requeued, _, _ := s.Reap("q"); !reflect.DeepEqual(requeued, []string{"due"}) {
+		t.Errorf("requeued %v, want [due]", requeued)
+	}
+	checkQueued(t, s, "q", nil)
+	scheduled, _ := s.Scheduled("q")
+	backedOff := false
+	for _, item := range scheduled {
+		backedOff = backedOff || item.Item == "due" && item.Due.Unix() >= now+600
+	}
+	if len(scheduled) != 2 || !backedOff {
+		t.Errorf("scheduled %+v, want due backed off", scheduled)
+	}
+}
+
+// Reaping goes by the time indexes, which follow leases as they are
+// extended or given back and scheduled items as they are removed.
+func TestMemoryReapIndexes(t *testing.T) {
+	q := newMemoryQueue(Settings{Lease: 60, BackoffFactor: 2, Order: OrderFIFO, Dedupe: DedupeReject,
+		DedupeWindow: 60})
+	rng := rand.New(rand.NewSource(1))
+	start := time.Unix(1000, 0)
+	for _, item := range []string{"a", "b", "c"} {
+		q.enqueue(Entry{Item: item}, start.Unix())
+	}
+	leases := q.next("", 60, 3, start, rng)
+	q.extend(leases[:1], 600, start)
+	q.complete(leases[2:], start)
+	q.enqueue(Entry{Item: "s", Due: 1030}, start.Unix())
+	q.remove(RemoveScheduled, []string{"s"})
+	q.enqueue(Entry{Item: "t", Due: 1090}, start.Unix())
+
+	if q.reapable(1059) {
+		t.Error("reapable before any lease ran out")
+	}
+	requeued, dead := q.reap(1060, rng)
+	if !reflect.DeepEqual(requeued, []string{"b"}) || dead != nil {
+		t.Errorf("reaped %v and %v at 1060, want b requeued", requeued, dead)
+	}
+	q.reap(1090, rng)
+	if got := q.listQueued(); !reflect.DeepEqual(got, []string{"t", "b"}) {
+		t.Errorf("queued %q at 1090, want [t b]", got)
+	}
+	if q.reapable(1599) || !q.reapable(1600) {
+		t.Error("a's extended lease is not reapable from 1600 only")
+	}
+
+	if !q.held("c", 1059) || q.held("c", 1060) {
+		t.Error("c is not held for the dedupe window only")
+	}
+	if q.completions.Len() != 0 {
+		t.Errorf("%d completions left after the window", q.completions.Len())
+	}
+}
+
+func TestMemoryDedupe(t *testing.T) {
+	s := newMemoryQueueStore(t, Settings{Lease: 60, BackoffFactor: 2, Order: OrderFIFO, Dedupe: DedupeReject,
+		DedupeWindow: 60})
+	enqueue(t, s, "a")
+	if status, _ := s.Enqueue("q", Entry{Item: "a"}); status != StatusDuplicate {
+		t.Errorf("enqueueing a queued item = %v, want %v", status, StatusDuplicate)
+	}
+	a := next(t, s, 1)[0]
+	if status, _ := s.Enqueue("q", Entry{Item: "a"}); status != StatusDuplicate {
+		t.Errorf("enqueueing a pending item = %v, want %v", status, StatusDuplicate)
+	}
+	s.Done("q", []Lease{a})
+	if status, _ := s.Enqueue("q", Entry{Item: "a"}); status != StatusDuplicate {
+		t.Errorf("enqueueing an item done within the window = %v, want %v", status, StatusDuplicate)
+	}
+
+	status, duplicates, _ := s.Bulk("q", []string{"b", "a"}, 0, 0, false)
+	if status != StatusDuplicate || !reflect.DeepEqual(duplicates, []string{"a"}) {
+		t.Errorf("Bulk = %v, %v, want a rejected", status, duplicates)
+	}
+	checkQueued(t, s, "q", nil)
+
+	settings, _ := s.Settings("q")
+	settings.Dedupe = DedupeIgnore
+	s.SaveSettings("q", settings)
+	status, duplicates, _ = s.Bulk("q", []string{"b", "a", "b"}, 0, 0, false)
+	if status != StatusOK || !reflect.DeepEqual(duplicates, []string{"a", "b"}) {
+		t.Errorf("Bulk = %v, %v, want a and the second b left out", status, duplicates)
+	}
+	if status, _ := s.Enqueue("q", Entry{Item: "b"}); status != StatusIgnored {
+		t.Errorf("enqueueing a queued item = %v, want %v", status, StatusIgnored)
+	}
+	checkQueued(t, s, "q", []string{"b"})
+
+	// Once removed, an item may come back.
+	if n, _ := s.Remove("q", RemoveAll, []string{"b"}); n != 1 {
+		t.Errorf("Remove = %v, want 1", n)
+	}
+	enqueue(t, s, "b")
+}
+
+func TestMemoryDedupeOff(t *testing.T) {
+	s := newMemoryQueueStore(t, DefaultSettings)
+	enqueue(t, s, "a", "a")
+	s.Enqueue("q", Entry{Item: "a", Due: time.Now().Unix() + 600})
+	s.Enqueue("q", Entry{Item: "a", Due: time.Now().Unix() + 600})
+	checkQueued(t, s, "q", []string{"a", "a"})
+	if scheduled, _ := s.Scheduled("q"); len(scheduled) != 2 {
+		t.Errorf("scheduled %+v, want both copies", scheduled)
+	}
+	if n, _ := s.Remove("q", RemoveAll, []string{"a"}); n != 4 {
+		t.Errorf("Remove = %v, want 4", n)
+	}
+	if _, err := s.Item("q", "a"); err != ErrNotFound {
+		t.Errorf("Item after removing every copy = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryOrder(t *testing.T) {
+	tests := []struct {
+		order string
+		want  []string
+	}{
+		{OrderFIFO, []string{"a", "b", "c"}},
+		{OrderLIFO, []string{"c", "b", "a"}},
+	}
+	for _, test := range tests {
+		s := newMemoryQueueStore(t, Settings{Lease: 60, BackoffFactor: 2, Order: test.order, Dedupe: DedupeOff})
+		enqueue(t, s, "a", "b", "c")
+		if served := leasedItems(next(t, s, 3)); !reflect.DeepEqual(served, test.want) {
+			t.Errorf("%v served %v, want %v", test.order, served, test.want)
+		}
+	}
+
+	s := newMemoryQueueStore(t, Settings{Lease: 60, BackoffFactor: 2, Order: OrderRandom, Dedupe: DedupeOff})
+	enqueue(t, s, "a", "b", "c")
+	served := leasedItems(next(t, s, 5))
+	sort.Strings(served)
+	if !reflect.DeepEqual(served, []string{"a", "b", "c"}) {
+		t.Errorf("random served %v, want every item once", served)
+	}
+}
+
+func TestMemoryPriority(t *testing.T) {
+	s := newMemoryQueueStore(t, DefaultSettings)
+	s.Enqueue("q", Entry{Item: "low", Priority: -1})
+	s.Enqueue("q", Entry{Item: "a"})
+	s.Enqueue("q", Entry{Item: "high", Priority: 5})
+	s.Enqueue("q", Entry{Item: "b"})
+	s.Bulk("q", []string{"higher"}, 10, 0, false)
+
+	checkQueued(t, s, "q", []string{"higher", "high", "b", "a", "low"})
+	stats, _ := s.Stats("q")
+	want := []PriorityCount{{10, 1}, {5, 1}, {0, 2}, {-1, 1}}
+	if !reflect.DeepEqual(stats.ByPriority, want) {
+		t.Errorf("by priority %v, want %v", stats.ByPriority, want)
+	}
+	if info, _ := s.Item("q", "a"); info.Position == nil || *info.Position != 2 {
+		t.Errorf("item %+v, want position 2", info)
+	}
+	if served := leasedItems(next(t, s, 5)); !reflect.DeepEqual(served, []string{"higher", "high", "a", "b", "low"}) {
+		t.Errorf("served %v", served)
+	}
+}
+
+// Deleting a queue takes its lease counter and idempotency keys with it, and
+// clearing one resets the counter.
+func TestMemoryDeleteForgets(t *testing.T) {
+	s := newMemoryQueueStore(t, DefaultSettings)
+	if _, claimed, _ := s.ClaimIdempotencyKey("q", "/q/enqueue-k", 60); !claimed {
+		t.Fatal("did not claim a new idempotency key")
+	}
+	s.SaveIdempotencyKey("q", "/q/enqueue-k", []byte("saved"), 60)
+	enqueue(t, s, "a")
+	next(t, s, 1)
+
+	s.DeleteQueue("q")
+	s.CreateQueue("q", DefaultSettings)
+	if saved, claimed, _ := s.ClaimIdempotencyKey("q", "/q/enqueue-k", 60); !claimed {
+		t.Errorf("idempotency key outlived its queue, saved %q", saved)
+	}
+	enqueue(t, s, "a")
+	if leases := next(t, s, 1); len(leases) != 1 || leases[0].Token != "a:1" {
+		t.Errorf("leased %+v after recreating, want a:1", leases)
+	}
+
+	s.Bulk("q", []string{"b"}, 0, 0, true)
+	if leases := next(t, s, 1); len(leases) != 1 || leases[0].Token != "b:1" {
+		t.Errorf("leased %+v after clearing, want b:1", leases)
+	}
+}
+
+func TestMemoryEnqueueMissing(t *testing.T) {
+	s := newMemoryQueueStore(t, DefaultSettings)
+	s.DeleteQueue("q")
+	if status, err := s.Enqueue("q", Entry{Item: "a"}); status != StatusMissing || err != nil {
+		t.Errorf("Enqueue to a deleted queue = %v, %v, want %v", status, err, StatusMissing)
+	}
+	if ok, _ := s.Exists("q"); ok {
+		t.Error("Enqueue recreated a deleted queue")
+	}
+}
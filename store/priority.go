@@ -0,0 +1,36 @@
+package store
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+)
+
+// queuedKey returns the queued list of a priority, as queuedLua does.
+func queuedKey(qid string, priority int) string {
+	if priority == 0 {
+		return key(qid, "queued")
+	}
+	return key(qid, "queued-"+strconv.Itoa(priority))
+}
+
+// loadPriorities returns the priorities in use by a queue, highest first,
+// always with 0.
+func loadPriorities(r redis.Conn, qid string) ([]int, error) {
+	others, err := redis.Ints(r.Do("ZREVRANGE", key(qid, "priorities"), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	priorities := make([]int, 0, len(others)+1)
+	zero := false
+	for _, priority := range others {
+		if !zero && priority < 0 {
+			priorities = append(priorities, 0)
+			zero = true
+		}
+		priorities = append(priorities, priority)
+	}
+	if !zero {
+		priorities = append(priorities, 0)
+	}
+	return priorities, nil
+}
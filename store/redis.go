@@ -0,0 +1,592 @@
+package store
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"log"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// Redis keeps queues in Redis. Queues are registered in the "queues" set
+// and keep their items in keys starting with "queues-{<qid>}-", laid out as
+// described in scripts.go. The qid is a hash tag, so that the keys of a
+// queue share a hash slot and scripts may touch them together on Redis
+// Cluster, within the limits given there. The registry lives in another slot, so scripts create and delete
+// queues through their "queues-{<qid>}-created" marker and the registry is
+// brought in line with the marker afterwards.
+type Redis struct {
+	pool *redis.Pool
+	dial func() (redis.Conn, error)
+}
+
+// NewRedis connects to Redis through dial, loads the scripts and brings the
+// queues left by older versions up to date.
+func NewRedis(dial func() (redis.Conn, error)) (*Redis, error) {
+	s := &Redis{pool: redis.NewPool(dial, 10), dial: dial}
+	if err := s.migrate(); err != nil {
+		s.pool.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Redis) migrate() error {
+	r := s.pool.Get()
+	defer r.Close()
+	if err := loadScripts(r); err != nil {
+		return err
+	}
+
+	qids, err := redis.Strings(r.Do("SMEMBERS", "queues"))
+	if err != nil {
+		return err
+	}
+	for _, qid := range qids {
+		old, err := hasOldKeys(r, qid)
+		if err != nil {
+			return err
+		}
+		if old {
+			return ErrOldKeys
+		}
+		// Queues created before markers existed.
+		if _, err := r.Do("SET", key(qid, "created"), 1, "NX"); err != nil {
+			return err
+		}
+		migrated, err := redis.Int(runScript(r, migrateScript, qid, time.Now().Unix()))
+		if err != nil {
+			return err
+		}
+		if migrated > 0 {
+			log.Printf("Migrated %v pending items of queue %v", migrated, qid)
+		}
+	}
+	return nil
+}
+
+// key returns the key of a queue holding name, or the prefix of its keys if
+// name is "".
+func key(qid, name string) string {
+	return "queues-{" + qid + "}-" + name
+}
+
+func (s *Redis) Close() error {
+	return s.pool.Close()
+}
+
+func (s *Redis) Queues() ([]string, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	return redis.Strings(r.Do("SMEMBERS", "queues"))
+}
+
+func (s *Redis) Exists(qid string) (bool, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	return redis.Bool(r.Do("SISMEMBER", "queues", qid))
+}
+
+func (s *Redis) CreateQueue(qid string, settings Settings) (bool, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	created, err := saveSettings(r, qid, settings, true)
+	if err != nil {
+		return false, err
+	}
+	return created, register(r, qid)
+}
+
+func (s *Redis) DeleteQueue(qid string) (bool, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	deleted, err := redis.Bool(runScript(r, deleteScript, qid))
+	if err != nil {
+		return false, err
+	}
+	return deleted, register(r, qid)
+}
+
+// register brings the registry in line with the marker of a queue once a
+// script created or deleted it. Of a create and a delete racing each other,
+// the one whose script ran last decides, as the other registers again after
+// its own change.
+func register(r redis.Conn, qid string) error {
+	created, err := redis.Bool(r.Do("EXISTS", key(qid, "created")))
+	if err != nil {
+		return err
+	}
+	if created {
+		_, err = r.Do("SADD", "queues", qid)
+	} else {
+		_, err = r.Do("SREM", "queues", qid)
+	}
+	return err
+}
+
+func (s *Redis) Settings(qid string) (Settings, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	return loadSettings(r, qid)
+}
+
+func (s *Redis) SaveSettings(qid string, settings Settings) error {
+	r := s.pool.Get()
+	defer r.Close()
+	_, err := saveSettings(r, qid, settings, false)
+	return err
+}
+
+// loadSettings reads the "queues-{<qid>}-settings" hash over the defaults.
+func loadSettings(r redis.Conn, qid string) (Settings, error) {
+	values, err := redis.StringMap(r.Do("HGETALL", key(qid, "settings")))
+	if err != nil {
+		return Settings{}, err
+	}
+	settings := DefaultSettings
+	for field, v := range settings.Fields() {
+		if value, ok := values[field]; ok {
+			if *v, err = strconv.Atoi(value); err != nil {
+				return Settings{}, err
+			}
+		}
+	}
+	if factor, ok := values["backoff_factor"]; ok {
+		if settings.BackoffFactor, err = strconv.ParseFloat(factor, 64); err != nil {
+			return Settings{}, err
+		}
+	}
+	if order, ok := values["order"]; ok {
+		settings.Order = order
+	}
+	if dedupe, ok := values["dedupe"]; ok {
+		settings.Dedupe = dedupe
+	}
+	return settings, nil
+}
+
+// saveSettings stores the settings in the "queues-{<qid>}-settings" hash of
+// a queue that exists, or of a new queue if create is set. Returns false if
+// the queue was not in the state expected.
+func saveSettings(r redis.Conn, qid string, settings Settings, create bool) (bool, error) {
+	createArg := ""
+	if create {
+		createArg = "1"
+	}
+	args := []interface{}{createArg, "order", settings.Order, "dedupe", settings.Dedupe,
+		"backoff_factor", settings.BackoffFactor}
+	for field, v := range settings.Fields() {
+		args = append(args, field, *v)
+	}
+	return redis.Bool(runScript(r, settingsScript, qid, args...))
+}
+
+// retryArgs are the script arguments deciding where an item given back to
+// the queue goes: max attempts, the backoff settings and a seed for jitter.
+func retryArgs(settings Settings) []interface{} {
+	return []interface{}{settings.MaxAttempts, settings.Backoff, settings.BackoffFactor,
+		settings.BackoffMax, settings.BackoffJitter, rand.Int63n(1 << 31)}
+}
+
+func (s *Redis) Enqueue(qid string, entry Entry) (string, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	return redis.String(runScript(r, enqueueScript, qid, entry.Item, entry.Priority, entry.Due, entry.Payload,
+		time.Now().Unix()))
+}
+
+func (s *Redis) Bulk(qid string, items []string, priority int, due int64, clear bool) (string, []string, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	clearArg := ""
+	if clear {
+		clearArg = "1"
+	}
+	args := []interface{}{clearArg, priority, due, time.Now().Unix()}
+	for _, item := range items {
+		args = append(args, item)
+	}
+	result, err := redis.Values(runScript(r, bulkScript, qid, args...))
+	if err != nil {
+		return "", nil, err
+	}
+	if err := register(r, qid); err != nil {
+		return "", nil, err
+	}
+	status, err := redis.String(result[0], nil)
+	if err != nil {
+		return "", nil, err
+	}
+	duplicates, err := redis.Strings(result[1], nil)
+	return status, duplicates, err
+}
+
+func (s *Redis) Next(qid, ip string, seconds, count int) ([]Lease, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	values, err := redis.Strings(runScript(r, nextScript, qid, ip, seconds, time.Now().Unix(), count,
+		rand.Int63n(1<<31)))
+	if err != nil {
+		return nil, err
+	}
+	leases := make([]Lease, 0, len(values)/3)
+	for i := 0; i < len(values); i += 3 {
+		leases = append(leases, Lease{values[i], values[i+1], values[i+2]})
+	}
+	return leases, nil
+}
+
+// Wait pops the priority 0 list on a connection of its own so that waiting
+// workers do not starve the pool, and takes a pooled connection only to
+// lease what it finds.
+//
+// Only the priority 0 list can be waited on, so the pop gives up every
+// second to let Next look at the other priorities. Pops time out in whole
+// seconds, so the last one may outlast the wait by up to a second. The
+// blocking pop serves the head of the list whatever the queue's order; it
+// only runs once the queue was found empty, so the first item to arrive is
+// taken.
+func (s *Redis) Wait(qid, ip string, seconds int, wait time.Duration, cancel <-chan bool) ([]Lease, error) {
+	conn, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	gone := make(chan struct{})
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-cancel:
+			// Unblocks the pop below. An item popped just before is left
+			// on the claimed list for the reaper.
+			close(gone)
+			conn.Close()
+		case <-finished:
+		}
+	}()
+
+	until := time.Now().Add(wait)
+	for {
+		left := until.Sub(time.Now())
+		if left <= 0 {
+			return nil, nil
+		}
+		item, err := redis.String(conn.Do("BRPOPLPUSH", key(qid, "queued"), key(qid, "claimed"), 1))
+		if err == redis.ErrNil {
+			leases, err := s.Next(qid, ip, seconds, 1)
+			if err != nil || len(leases) > 0 {
+				return leases, err
+			}
+			continue
+		}
+		if err != nil {
+			select {
+			case <-gone:
+				return nil, nil
+			default:
+				return nil, err
+			}
+		}
+
+		lease, err := s.claim(qid, ip, seconds, item)
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []Lease{{lease[0], lease[1], lease[2]}}, nil
+	}
+}
+
+// claim leases an item popped by Wait. Returns redis.ErrNil if the reaper
+// requeued it meanwhile.
+func (s *Redis) claim(qid, ip string, seconds int, item string) ([]string, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	return redis.Strings(runScript(r, claimScript, qid, ip, seconds, time.Now().Unix(), item))
+}
+
+// leaseArgs appends the item and token pairs of leases to script arguments.
+func leaseArgs(args []interface{}, leases []Lease) []interface{} {
+	for _, lease := range leases {
+		args = append(args, lease.Item, lease.Token)
+	}
+	return args
+}
+
+func (s *Redis) Done(qid string, leases []Lease) ([]string, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	args := []interface{}{time.Now().Unix()}
+	return redis.Strings(runScript(r, doneScript, qid, leaseArgs(args, leases)...))
+}
+
+func (s *Redis) Extend(qid string, seconds int, leases []Lease) ([]string, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	args := []interface{}{seconds, time.Now().Unix()}
+	return redis.Strings(runScript(r, extendScript, qid, leaseArgs(args, leases)...))
+}
+
+func (s *Redis) TTL(qid, item, token string) (int, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	ttl, err := redis.Int(runScript(r, ttlScript, qid, item, token))
+	if isConflict(err) {
+		return 0, ErrConflict
+	}
+	return ttl, err
+}
+
+func (s *Redis) Expire(qid, item, token string) (bool, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	expired, err := redis.Bool(runScript(r, expireScript, qid, item, token))
+	if isConflict(err) {
+		return false, ErrConflict
+	}
+	return expired, err
+}
+
+func (s *Redis) Release(qid, item, token string, head bool, due int64) (string, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	settings, err := loadSettings(r, qid)
+	if err != nil {
+		return "", err
+	}
+	position := "tail"
+	if head {
+		position = "head"
+	}
+	args := []interface{}{item, token, position, due, time.Now().Unix()}
+	return redis.String(runScript(r, releaseScript, qid, append(args, retryArgs(settings)...)...))
+}
+
+func (s *Redis) Redrive(qid string) (int, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	return redis.Int(runScript(r, redriveScript, qid, time.Now().Unix()))
+}
+
+func (s *Redis) Remove(qid, where string, items []string) (int, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	return remove(r, qid, where, items)
+}
+
+func remove(r redis.Conn, qid, where string, items []string) (int, error) {
+	args := []interface{}{where}
+	for _, item := range items {
+		args = append(args, item)
+	}
+	return redis.Int(runScript(r, removeScript, qid, args...))
+}
+
+func (s *Redis) Purge(qid, where string, match func(string) bool) (int, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	items, err := loadRemovable(r, qid, where, match)
+	if err != nil {
+		return 0, err
+	}
+	return remove(r, qid, where, items)
+}
+
+// loadRemovable returns the distinct items that are queued, scheduled or
+// both and that match.
+func loadRemovable(r redis.Conn, qid, where string, match func(string) bool) ([]string, error) {
+	var candidates []string
+	if where != RemoveScheduled {
+		items, err := loadQueued(r, qid)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, items...)
+	}
+	if where != RemoveQueued {
+		members, err := redis.Strings(r.Do("ZRANGE", key(qid, "scheduled"), 0, -1))
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range members {
+			candidates = append(candidates, scheduledItem(member))
+		}
+	}
+
+	seen := make(map[string]bool)
+	var matched []string
+	for _, item := range candidates {
+		if !seen[item] && match(item) {
+			matched = append(matched, item)
+		}
+		seen[item] = true
+	}
+	return matched, nil
+}
+
+// loadQueued returns the queued items of every priority, highest first.
+func loadQueued(r redis.Conn, qid string) ([]string, error) {
+	priorities, err := loadPriorities(r, qid)
+	if err != nil {
+		return nil, err
+	}
+	var queued []string
+	for _, priority := range priorities {
+		items, err := redis.Strings(r.Do("LRANGE", queuedKey(qid, priority), 0, -1))
+		if err != nil {
+			return nil, err
+		}
+		queued = append(queued, items...)
+	}
+	return queued, nil
+}
+
+// Lead keeps the lease in the "queues-reaper-leader" key.
+func (s *Redis) Lead(holder string, lease time.Duration) (bool, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	return redis.Bool(leaderScript.Do(r, "queues-reaper-leader", holder, int64(lease/time.Millisecond)))
+}
+
+func (s *Redis) Reap(qid string) ([]string, []string, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	settings, err := loadSettings(r, qid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	args := []interface{}{time.Now().Unix()}
+	moved, err := redis.Values(runScript(r, requeueScript, qid, append(args, retryArgs(settings)...)...))
+	if err != nil {
+		return nil, nil, err
+	}
+	requeued, err := redis.Strings(moved[0], nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	dead, err := redis.Strings(moved[1], nil)
+	return requeued, dead, err
+}
+
+func (s *Redis) Stats(qid string) (Stats, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	var stats Stats
+	priorities, err := loadPriorities(r, qid)
+	if err != nil {
+		return stats, err
+	}
+	for _, priority := range priorities {
+		n, err := redis.Int(r.Do("LLEN", queuedKey(qid, priority)))
+		if err != nil {
+			return stats, err
+		}
+		stats.Queued += n
+		stats.ByPriority = append(stats.ByPriority, PriorityCount{priority, n})
+	}
+	if stats.Pending, err = redis.Int(r.Do("ZCARD", key(qid, "pending"))); err != nil {
+		return stats, err
+	}
+	if stats.Done, err = redis.Int(r.Do("LLEN", key(qid, "done"))); err != nil {
+		return stats, err
+	}
+	stats.Dead, err = redis.Int(r.Do("LLEN", key(qid, "dead")))
+	return stats, err
+}
+
+func (s *Redis) List(qid, state string) ([]string, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	if state == StateQueued {
+		return loadQueued(r, qid)
+	}
+	return redis.Strings(r.Do("LRANGE", key(qid, state), 0, -1))
+}
+
+func (s *Redis) Pending(qid string) ([]PendingItem, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	tokens, err := redis.Strings(r.Do("ZRANGE", key(qid, "pending"), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, token := range tokens {
+		r.Send("GET", key(qid, "lease-"+token))
+		r.Send("TTL", key(qid, "lease-"+token))
+	}
+	if err := r.Flush(); err != nil {
+		return nil, err
+	}
+	pending := make([]PendingItem, 0, len(tokens))
+	for _, token := range tokens {
+		// A lease running out between the commands leaves no ip.
+		ip, err := redis.String(r.Receive())
+		if err != nil && err != redis.ErrNil {
+			return nil, err
+		}
+		ttl, err := redis.Int(r.Receive())
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, PendingItem{tokenItem(token), ip, ttl})
+	}
+	return pending, nil
+}
+
+func (s *Redis) Scheduled(qid string) ([]ScheduledItem, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	values, err := redis.Strings(r.Do("ZRANGE", key(qid, "scheduled"), 0, -1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	scheduled := make([]ScheduledItem, 0, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		due, err := strconv.ParseFloat(values[i+1], 64)
+		if err != nil {
+			return nil, err
+		}
+		scheduled = append(scheduled, ScheduledItem{scheduledItem(values[i]), time.Unix(int64(due), 0)})
+	}
+	return scheduled, nil
+}
+
+func (s *Redis) Item(qid, item string) (*ItemInfo, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	info, err := loadItemInfo(r, qid, item)
+	if err == redis.ErrNil {
+		return nil, ErrNotFound
+	}
+	return info, err
+}
+
+func (s *Redis) ClaimIdempotencyKey(qid, name string, window int) ([]byte, bool, error) {
+	r := s.pool.Get()
+	defer r.Close()
+	saved, err := redis.Bytes(runScript(r, claimKeyScript, qid, name, window, time.Now().Unix()))
+	if err == redis.ErrNil {
+		return nil, true, nil
+	}
+	return saved, false, err
+}
+
+func (s *Redis) SaveIdempotencyKey(qid, name string, response []byte, window int) error {
+	r := s.pool.Get()
+	defer r.Close()
+	_, err := runScript(r, saveKeyScript, qid, name, response, window, time.Now().Unix())
+	return err
+}
+
+func (s *Redis) ForgetIdempotencyKey(qid, name string) error {
+	r := s.pool.Get()
+	defer r.Close()
+	_, err := runScript(r, forgetKeyScript, qid, name)
+	return err
+}
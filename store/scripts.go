@@ -0,0 +1,931 @@
+package store
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"regexp"
+	"strings"
+)
+
+// Every state transition of an item is a single Lua script so that Redis
+// applies it all-or-nothing. Scripts on a queue are given its fixed keys as
+// KEYS, and the "queues-{<qid>}-" key prefix to build the keys of leases,
+// item metadata, priorities other than 0 and idempotency keys, which are
+// only known inside the script. Those keys are not declared, as Redis asks of scripts on
+// Redis Cluster. They share the {<qid>} hash tag with the declared keys, so
+// they live on the node running the script and Redis Cluster accepts them
+// today, but proxies routing scripts by their KEYS alone and later versions
+// of Redis may not.
+//
+// The pending set is a sorted set scored by lease deadline (unix seconds),
+// so expired leases can be found without looking at every pending item.
+// Times are passed in by the caller because scripts may not read the clock
+// before writing.
+//
+// Every delivery of an item is a lease with its own token, "<item>:<n>" with
+// n taken from a per-queue counter. The pending set holds tokens rather than
+// items, and the lease key "queues-{<qid>}-lease-<token>" holds the
+// worker's ip until the lease runs out, so two deliveries of equal items
+// never share a lease. The last token of each item is kept in the
+// "queues-{<qid>}-delivered" hash. Scripts acting on a lease refuse callers
+// whose token is not pending, so a worker whose lease was requeued can no
+// longer touch the item.
+//
+// Deliveries of an item are counted in the "queues-{<qid>}-attempts" hash.
+// An item that runs out of attempts goes to the dead list instead of back to
+// queued.
+//
+// Queued items wait in one list per priority: "queues-{<qid>}-queued" for
+// priority 0 and "queues-{<qid>}-queued-<priority>" for the others. The
+// priorities other than 0 in use are kept in the "queues-{<qid>}-priorities"
+// sorted set, and the priority of each item in the "queues-{<qid>}-priority"
+// hash so that it goes back to the right list.
+//
+// An item is its ID. Items enqueued with a payload keep it in the
+// "queues-{<qid>}-payloads" hash under their ID until they are done, so the
+// payload may hold anything while IDs stay fit for lists and key names.
+//
+// Items are served from the right end of a list. New items are pushed on
+// the left in fifo queues and on the right in lifo queues; random queues
+// push on the left and serve from anywhere in the list. Items given back
+// to the queue after a delivery go to the right, so they are served next
+// whatever the order, unless released to the tail.
+//
+// The "queues-{<qid>}-present" hash counts the copies of each item that are
+// queued, scheduled or pending, and "queues-{<qid>}-recent" scores done items
+// by completion time, so that queues which dedupe can refuse items they
+// already hold or recently did.
+//
+// Scheduled items wait in the "queues-{<qid>}-scheduled" sorted set, scored
+// by due time. Each copy of an item is a member of its own: the first is
+// the item, the others "<item>\n<n>", since items hold no newlines.
+//
+// Every item has a "queues-{<qid>}-meta-<item>" hash kept up by each
+// transition: its state (queued, scheduled, pending, done or dead), when it
+// changed, when the item was enqueued, leased and completed, when it is due
+// if scheduled and its lease token if pending.
+//
+// The response to a request with an Idempotency-Key is kept in
+// "queues-{<qid>}-idempotency-<name>" until the window runs out. The names
+// are scored by expiry in the "queues-{<qid>}-idempotency" sorted set, so
+// that deleting the queue finds them.
+
+// conflictPrefix starts the error raised by scripts on a token mismatch.
+const conflictPrefix = "CONFLICT "
+
+func isConflict(err error) bool {
+	e, ok := err.(redis.Error)
+	return ok && strings.HasPrefix(string(e), conflictPrefix)
+}
+
+// scheduledItem returns the item a member of the scheduled set is a copy
+// of, as scheduledItem in scheduledLua does.
+func scheduledItem(member string) string {
+	if i := strings.Index(member, "\n"); i >= 0 {
+		return member[:i]
+	}
+	return member
+}
+
+var tokenPattern = regexp.MustCompile(`^(.*):\d+$`)
+
+// tokenItem returns the item a lease token was given for, as itemOf does.
+func tokenItem(token string) string {
+	if m := tokenPattern.FindStringSubmatch(token); m != nil {
+		return m[1]
+	}
+	return token
+}
+
+// queueKeyNames are the fixed keys of a queue, "queues-{<qid>}-<name>".
+// Scripts on a queue are given them as KEYS in this order.
+var queueKeyNames = []string{"created", "settings", "queued", "priorities", "priority", "pending", "leases",
+	"delivered", "attempts", "done", "dead", "claimed", "scheduled", "payloads", "present", "recent", "idempotency"}
+
+// keysLua names the KEYS of a queue script after queueKeyNames, as k.pending
+// and so on.
+var keysLua = `
+local k = {}
+for i, name in ipairs({'` + strings.Join(queueKeyNames, "', '") + `'}) do
+	k[name] = KEYS[i]
+end
+`
+
+// newQueueScript returns a script run on a queue by runScript.
+func newQueueScript(src string) *redis.Script {
+	return redis.NewScript(len(queueKeyNames), keysLua+src)
+}
+
+// runScript runs a script on a queue, with the fixed keys of the queue as
+// KEYS and its key prefix followed by args as ARGV.
+func runScript(r redis.Conn, script *redis.Script, qid string, args ...interface{}) (interface{}, error) {
+	keysAndArgs := make([]interface{}, 0, len(queueKeyNames)+1+len(args))
+	for _, name := range queueKeyNames {
+		keysAndArgs = append(keysAndArgs, key(qid, name))
+	}
+	keysAndArgs = append(keysAndArgs, key(qid, ""))
+	return script.Do(r, append(keysAndArgs, args...)...)
+}
+
+// leaseLua is shared by the scripts that grant, check or drop leases. It
+// needs metaLua.
+const leaseLua = `
+local function leaseKey(base, token)
+	return base .. 'lease-' .. token
+end
+
+-- itemOf returns the item of a lease token. Pending items of versions
+-- before tokens are their own token.
+local function itemOf(token)
+	return string.match(token, '^(.*):%d+$') or token
+end
+
+-- grantLease puts an item on pending under a new lease and returns the
+-- lease token.
+local function grantLease(base, item, ip, timeout, now)
+	local token = item .. ':' .. redis.call('INCR', k.leases)
+	redis.call('HINCRBY', k.attempts, item, 1)
+	redis.call('HSET', k.delivered, item, token)
+	redis.call('ZADD', k.pending, now + timeout, token)
+	redis.call('SET', leaseKey(base, token), ip, 'EX', timeout)
+	setState(base, item, 'pending', now, 'leased', now, 'token', token)
+	return token
+end
+
+-- leaseStatus checks that an item is pending under the given token. Any
+-- other token conflicts if the item is leased, and is not pending if it is
+-- not.
+local function leaseStatus(base, item, token)
+	if itemOf(token) ~= item or redis.call('ZSCORE', k.pending, token) == false then
+		local last = redis.call('HGET', k.delivered, item)
+		if last and last ~= token then
+			return 'conflict'
+		end
+		return 'not pending'
+	end
+	if redis.call('EXISTS', leaseKey(base, token)) == 0 then
+		return 'lease expired'
+	end
+	return 'ok'
+end
+
+-- dropLease takes a lease off pending.
+local function dropLease(base, token)
+	redis.call('ZREM', k.pending, token)
+	redis.call('DEL', leaseKey(base, token))
+	local item = itemOf(token)
+	if redis.call('HGET', k.delivered, item) == token then
+		redis.call('HDEL', k.delivered, item)
+	end
+end
+`
+
+// queuedLua is shared by the scripts that take items from or give items to
+// the queued lists.
+const queuedLua = `
+local function queuedKey(base, priority)
+	if tonumber(priority) == 0 then
+		return k.queued
+	end
+	return base .. 'queued-' .. priority
+end
+
+-- priorities returns the priorities in use, highest first, always with 0.
+local function priorities()
+	local result, zero = {}, false
+	for _, priority in ipairs(redis.call('ZREVRANGE', k.priorities, 0, -1)) do
+		if not zero and tonumber(priority) < 0 then
+			table.insert(result, '0')
+			zero = true
+		end
+		table.insert(result, priority)
+	end
+	if not zero then
+		table.insert(result, '0')
+	end
+	return result
+end
+
+local function order()
+	return redis.call('HGET', k.settings, 'order') or 'fifo'
+end
+
+-- push puts an item on the list of its priority, either at the head so it
+-- is served next or at the tail.
+local function push(base, item, head)
+	local priority = tonumber(redis.call('HGET', k.priority, item)) or 0
+	if priority ~= 0 then
+		redis.call('ZADD', k.priorities, priority, priority)
+	end
+	if head then
+		redis.call('RPUSH', queuedKey(base, priority), item)
+	else
+		redis.call('LPUSH', queuedKey(base, priority), item)
+	end
+end
+
+-- append puts a new item on the queue where the queue's order wants it.
+local function append(base, item)
+	push(base, item, order() == 'lifo')
+end
+
+-- popRandom takes an item anywhere in a list, moving the head item into its
+-- place.
+local function popRandom(key)
+	local n = redis.call('LLEN', key)
+	if n == 0 then
+		return false
+	end
+	local i = math.random(n) - 1
+	local item = redis.call('LINDEX', key, i)
+	local head = redis.call('RPOP', key)
+	if i < n - 1 then
+		redis.call('LSET', key, i, head)
+	end
+	return item
+end
+
+-- pop takes the next item of the highest priority. Random queues need the
+-- caller to seed math.random.
+local function pop(base)
+	local random = order() == 'random'
+	for _, priority in ipairs(priorities()) do
+		local item
+		if random then
+			item = popRandom(queuedKey(base, priority))
+		else
+			item = redis.call('RPOP', queuedKey(base, priority))
+		end
+		if item then
+			return item
+		end
+		if tonumber(priority) ~= 0 then
+			redis.call('ZREM', k.priorities, priority)
+		end
+	end
+	return false
+end
+
+-- setPriority records the priority of an item about to be enqueued.
+local function setPriority(item, priority)
+	if tonumber(priority) == 0 then
+		redis.call('HDEL', k.priority, item)
+	else
+		redis.call('HSET', k.priority, item, priority)
+	end
+end
+`
+
+// scheduledLua is shared by the scripts that schedule items or take them
+// off the scheduled set.
+const scheduledLua = `
+-- schedule puts a copy of an item on the scheduled set, under a member of
+-- its own.
+local function schedule(item, due)
+	local member, n = item, 0
+	while redis.call('ZADD', k.scheduled, 'NX', due, member) == 0 do
+		n = n + 1
+		member = item .. '\n' .. n
+	end
+end
+
+-- scheduledItem returns the item a member of the scheduled set is a copy
+-- of.
+local function scheduledItem(member)
+	return string.match(member, '^[^\n]*')
+end
+`
+
+// metaLua is shared by the scripts that move items between states. Times
+// are unix seconds.
+const metaLua = `
+local function metaKey(base, item)
+	return base .. 'meta-' .. item
+end
+
+-- setState records the state of an item along with the given field and
+-- value pairs.
+local function setState(base, item, state, now, ...)
+	local key = metaKey(base, item)
+	redis.call('HMSET', key, 'state', state, 'updated', now, ...)
+	if state ~= 'pending' then
+		redis.call('HDEL', key, 'token')
+	end
+	if state ~= 'scheduled' then
+		redis.call('HDEL', key, 'due')
+	end
+end
+
+-- setEnqueued starts the metadata of an item entering the queue afresh.
+local function setEnqueued(base, item, now, due)
+	redis.call('DEL', metaKey(base, item))
+	if tonumber(due) > 0 then
+		setState(base, item, 'scheduled', now, 'enqueued', now, 'due', due)
+	else
+		setState(base, item, 'queued', now, 'enqueued', now)
+	end
+end
+`
+
+// dropMetaLua drops the metadata of every item a queue holds, before the
+// queue is cleared or deleted. It needs leaseLua, queuedLua and
+// scheduledLua.
+const dropMetaLua = `
+local function dropMeta(base)
+	local function drop(items)
+		for _, item in ipairs(items) do
+			redis.call('DEL', metaKey(base, item))
+		end
+	end
+	for _, priority in ipairs(priorities()) do
+		drop(redis.call('LRANGE', queuedKey(base, priority), 0, -1))
+	end
+	drop(redis.call('LRANGE', k.claimed, 0, -1))
+	for _, member in ipairs(redis.call('ZRANGE', k.scheduled, 0, -1)) do
+		redis.call('DEL', metaKey(base, scheduledItem(member)))
+	end
+	drop(redis.call('LRANGE', k.done, 0, -1))
+	drop(redis.call('LRANGE', k.dead, 0, -1))
+	for _, token in ipairs(redis.call('ZRANGE', k.pending, 0, -1)) do
+		redis.call('DEL', metaKey(base, itemOf(token)))
+	end
+end
+`
+
+// presentLua is shared by the scripts that add items to a queue or take
+// them out for good. The dedupe settings are read from the settings hash.
+const presentLua = `
+local function dedupeMode()
+	return redis.call('HGET', k.settings, 'dedupe') or 'off'
+end
+
+local function dedupeWindow()
+	return tonumber(redis.call('HGET', k.settings, 'dedupe_window')) or 0
+end
+
+-- held tells whether an item is queued, scheduled or pending, or was done
+-- within the dedupe window.
+local function held(item, now)
+	if redis.call('HEXISTS', k.present, item) == 1 then
+		return true
+	end
+	local window = dedupeWindow()
+	if window > 0 then
+		redis.call('ZREMRANGEBYSCORE', k.recent, '-inf', now - window)
+		return redis.call('ZSCORE', k.recent, item) ~= false
+	end
+	return false
+end
+
+-- arrive counts a copy of an item entering the queue.
+local function arrive(item)
+	redis.call('HINCRBY', k.present, item, 1)
+end
+
+-- leave counts a copy of an item leaving the queue, for done when doneAt is
+-- given or else for dead. Returns true if it was the last copy.
+local function leave(item, doneAt)
+	local last = redis.call('HINCRBY', k.present, item, -1) <= 0
+	if last then
+		redis.call('HDEL', k.present, item)
+	end
+	if doneAt and dedupeWindow() > 0 then
+		redis.call('ZADD', k.recent, doneAt, item)
+	end
+	return last
+end
+`
+
+// retryLua is shared by the scripts that give items back to the queue. Given
+// the retry arguments of Settings, exhausted tells whether an item has
+// used up its attempts and backoff returns the seconds it waits before it is
+// queued again. The caller seeds the jitter since scripts must be
+// deterministic, readRetry seeds it while reading the retry arguments.
+const retryLua = `
+local function exhausted(item, retry)
+	local max = tonumber(retry[1])
+	local n = tonumber(redis.call('HGET', k.attempts, item)) or 0
+	return max > 0 and n >= max
+end
+
+local function backoff(item, retry)
+	local base, factor, max, jitter = tonumber(retry[2]), tonumber(retry[3]), tonumber(retry[4]), tonumber(retry[5])
+	if base <= 0 then
+		return 0
+	end
+	local n = tonumber(redis.call('HGET', k.attempts, item)) or 1
+	local delay = base * factor ^ (n - 1)
+	if max > 0 and delay > max then
+		delay = max
+	end
+	return delay * (1 + jitter / 100 * (2 * math.random() - 1))
+end
+
+local function readRetry(first)
+	math.randomseed(tonumber(ARGV[first + 5]))
+	return {unpack(ARGV, first, first + 5)}
+end
+`
+
+// enqueueScript adds an item to the queued list of its priority in the
+// queue's order, or to the scheduled set if it is due later. Returns the
+// status of the item: missing if there is no such queue, or duplicate or
+// ignored if the queue dedupes and already holds it.
+// ARGV: queue key prefix, item, priority, due time or 0, payload or "", now.
+var enqueueScript = newQueueScript(metaLua + queuedLua + scheduledLua + presentLua + `
+local base, item = ARGV[1], ARGV[2]
+if redis.call('EXISTS', k.created) == 0 then
+	return 'missing'
+end
+local mode = dedupeMode()
+if mode ~= 'off' and held(item, ARGV[6]) then
+	if mode == 'reject' then
+		return 'duplicate'
+	end
+	return 'ignored'
+end
+setPriority(item, ARGV[3])
+if ARGV[5] ~= '' then
+	redis.call('HSET', k.payloads, item, ARGV[5])
+end
+arrive(item)
+setEnqueued(base, item, ARGV[6], ARGV[4])
+if tonumber(ARGV[4]) > 0 then
+	schedule(item, ARGV[4])
+else
+	append(base, item)
+end
+return 'ok'
+`)
+
+// nextScript moves up to count items from the queued lists onto pending,
+// highest priority first, and leases them to the worker's ip.
+// Returns each item followed by its lease token and payload, "" if none.
+// ARGV: queue key prefix, ip, timeout, now, count, seed for random queues.
+var nextScript = newQueueScript(metaLua + leaseLua + queuedLua + `
+math.randomseed(tonumber(ARGV[6]))
+local leases = {}
+for i = 1, tonumber(ARGV[5]) do
+	local item = pop(ARGV[1])
+	if not item then
+		break
+	end
+	local token = grantLease(ARGV[1], item, ARGV[2], ARGV[3], ARGV[4])
+	table.insert(leases, item)
+	table.insert(leases, token)
+	table.insert(leases, redis.call('HGET', k.payloads, item) or '')
+end
+return leases
+`)
+
+// claimScript leases an item that a blocking /next moved from queued onto
+// the claimed list. Returns false if the item is no longer there because the
+// reaper gave it back to queued. Returns the item, its lease token and
+// payload otherwise.
+// ARGV: queue key prefix, ip, timeout, now, item.
+var claimScript = newQueueScript(metaLua + leaseLua + `
+local item = ARGV[5]
+if redis.call('LREM', k.claimed, 1, item) ~= 1 then
+	return false
+end
+local token = grantLease(ARGV[1], item, ARGV[2], ARGV[3], ARGV[4])
+return {item, token, redis.call('HGET', k.payloads, item) or ''}
+`)
+
+// doneScript moves items from pending to done and drops their leases. Once
+// no copy of an item is left in the queue, its attempt count, priority and
+// payload go as well. Returns the status of each item.
+// ARGV: queue key prefix, now, then item and token pairs.
+var doneScript = newQueueScript(metaLua + leaseLua + presentLua + `
+local base = ARGV[1]
+local statuses = {}
+for i = 3, #ARGV, 2 do
+	local item, token = ARGV[i], ARGV[i + 1]
+	local status = leaseStatus(base, item, token)
+	if status == 'ok' then
+		dropLease(base, token)
+		if leave(item, ARGV[2]) then
+			redis.call('HDEL', k.attempts, item)
+			redis.call('HDEL', k.priority, item)
+			redis.call('HDEL', k.payloads, item)
+		end
+		setState(base, item, 'done', ARGV[2], 'completed', ARGV[2])
+		redis.call('RPUSH', k.done, item)
+	end
+	table.insert(statuses, status)
+end
+return statuses
+`)
+
+// extendScript resets the leases of items. Returns the status of each item.
+// ARGV: queue key prefix, timeout, now, then item and token pairs.
+var extendScript = newQueueScript(metaLua + leaseLua + `
+local statuses = {}
+for i = 4, #ARGV, 2 do
+	local item, token = ARGV[i], ARGV[i + 1]
+	local status = leaseStatus(ARGV[1], item, token)
+	if status == 'ok' then
+		redis.call('EXPIRE', leaseKey(ARGV[1], token), ARGV[2])
+		redis.call('ZADD', k.pending, ARGV[3] + ARGV[2], token)
+	end
+	table.insert(statuses, status)
+end
+return statuses
+`)
+
+// ttlScript returns the seconds left on a lease, or a negative number as TTL
+// does if there is no lease.
+// ARGV: queue key prefix, item, token.
+var ttlScript = newQueueScript(metaLua + leaseLua + `
+local status = leaseStatus(ARGV[1], ARGV[2], ARGV[3])
+if status == 'conflict' then
+	return redis.error_reply('CONFLICT lease token mismatch')
+end
+if status ~= 'ok' then
+	return -2
+end
+return redis.call('TTL', leaseKey(ARGV[1], ARGV[3]))
+`)
+
+// expireScript drops the lease of an item and moves its deadline to the
+// past so the next clean requeues it. Returns 0 if there is no lease.
+// ARGV: queue key prefix, item, token.
+var expireScript = newQueueScript(metaLua + leaseLua + `
+local status = leaseStatus(ARGV[1], ARGV[2], ARGV[3])
+if status == 'conflict' then
+	return redis.error_reply('CONFLICT lease token mismatch')
+end
+if status ~= 'ok' then
+	return 0
+end
+redis.call('ZADD', k.pending, 'XX', 0, ARGV[3])
+return redis.call('DEL', leaseKey(ARGV[1], ARGV[3]))
+`)
+
+// releaseScript gives a leased item back to the queue, either at the head
+// so it is served next, at the tail, or to the scheduled set until it is due.
+// Returns the status of the item.
+// Without a due time the item waits out the queue's backoff, if any.
+// ARGV: queue key prefix, item, token, position ("head" or "tail"), due time
+// or 0, now, retry arguments.
+var releaseScript = newQueueScript(metaLua + leaseLua + queuedLua + scheduledLua + presentLua + retryLua + `
+local base, item, token = ARGV[1], ARGV[2], ARGV[3]
+local retry = readRetry(7)
+local status = leaseStatus(base, item, token)
+if status ~= 'ok' then
+	return status
+end
+dropLease(base, token)
+local due = tonumber(ARGV[5])
+if due == 0 then
+	local delay = backoff(item, retry)
+	if delay > 0 then
+		due = ARGV[6] + delay
+	end
+end
+if exhausted(item, retry) then
+	leave(item)
+	setState(base, item, 'dead', ARGV[6], 'completed', ARGV[6])
+	redis.call('RPUSH', k.dead, item)
+elseif due > 0 then
+	setState(base, item, 'scheduled', ARGV[6], 'due', due)
+	schedule(item, due)
+else
+	setState(base, item, 'queued', ARGV[6])
+	push(base, item, ARGV[4] ~= 'tail')
+end
+return status
+`)
+
+// requeueScript puts every pending item whose deadline has passed back on
+// queued, on the scheduled set if the queue backs off, or on the dead list
+// once it has run out of attempts. Items left on the claimed list by a
+// blocking /next that never leased them go back to queued as well, and so do
+// scheduled items that are due. Returns the requeued items and the dead
+// items.
+// ARGV: queue key prefix, now, retry arguments.
+var requeueScript = newQueueScript(metaLua + leaseLua + queuedLua + scheduledLua + presentLua + retryLua + `
+local base = ARGV[1]
+local retry = readRetry(3)
+local requeued, dead = {}, {}
+for _, token in ipairs(redis.call('ZRANGEBYSCORE', k.pending, '-inf', ARGV[2])) do
+	local item = itemOf(token)
+	dropLease(base, token)
+	local delay = backoff(item, retry)
+	if exhausted(item, retry) then
+		leave(item)
+		setState(base, item, 'dead', ARGV[2], 'completed', ARGV[2])
+		redis.call('RPUSH', k.dead, item)
+		table.insert(dead, item)
+	elseif delay > 0 then
+		setState(base, item, 'scheduled', ARGV[2], 'due', ARGV[2] + delay)
+		schedule(item, ARGV[2] + delay)
+		table.insert(requeued, item)
+	else
+		setState(base, item, 'queued', ARGV[2])
+		push(base, item, true)
+		table.insert(requeued, item)
+	end
+end
+while true do
+	local item = redis.call('LPOP', k.claimed)
+	if not item then
+		break
+	end
+	push(base, item, true)
+end
+for _, member in ipairs(redis.call('ZRANGEBYSCORE', k.scheduled, '-inf', ARGV[2])) do
+	redis.call('ZREM', k.scheduled, member)
+	local item = scheduledItem(member)
+	setState(base, item, 'queued', ARGV[2])
+	append(base, item)
+end
+return {requeued, dead}
+`)
+
+// redriveScript moves every dead item back to queued with a fresh attempt
+// count. Returns the number of items moved.
+// ARGV: queue key prefix, now.
+var redriveScript = newQueueScript(metaLua + queuedLua + presentLua + `
+local n = 0
+while true do
+	local item = redis.call('LPOP', k.dead)
+	if not item then
+		return n
+	end
+	redis.call('HDEL', k.attempts, item)
+	arrive(item)
+	redis.call('HDEL', metaKey(ARGV[1], item), 'completed')
+	setState(ARGV[1], item, 'queued', ARGV[2])
+	append(ARGV[1], item)
+	n = n + 1
+end
+`)
+
+// migrateScript brings the keys of a queue left by an older version up to
+// date: a pending list becomes the sorted set, pending items become lease
+// tokens keeping the remaining time of their lease, and the present counts
+// are taken from the queue if there are none, along with the state of the
+// items held that have no metadata. Returns the number of pending items
+// migrated.
+// ARGV: queue key prefix, now.
+var migrateScript = newQueueScript(metaLua + leaseLua + queuedLua + scheduledLua + `
+local base, now = ARGV[1], tonumber(ARGV[2])
+if redis.call('TYPE', k.pending).ok == 'list' then
+	local items = redis.call('LRANGE', k.pending, 0, -1)
+	redis.call('DEL', k.pending)
+	for _, item in ipairs(items) do
+		local ttl = redis.call('TTL', base .. 'item-' .. item .. '-time')
+		if ttl < 0 then
+			ttl = 0
+		end
+		redis.call('ZADD', k.pending, now + ttl, item)
+	end
+end
+
+local n = 0
+local pending = redis.call('ZRANGE', k.pending, 0, -1, 'WITHSCORES')
+for i = 1, #pending, 2 do
+	local item, deadline = pending[i], pending[i + 1]
+	local time, oldToken = base .. 'item-' .. item .. '-time', base .. 'item-' .. item .. '-token'
+	if redis.call('EXISTS', time) == 1 or redis.call('EXISTS', oldToken) == 1 then
+		local token = redis.call('GET', oldToken) or (item .. ':0')
+		local ttl = redis.call('TTL', time)
+		redis.call('ZREM', k.pending, item)
+		redis.call('ZADD', k.pending, deadline, token)
+		if ttl > 0 then
+			redis.call('SET', leaseKey(base, token), redis.call('GET', time), 'EX', ttl)
+		end
+		redis.call('HSET', k.delivered, item, token)
+		redis.call('DEL', time, oldToken)
+		n = n + 1
+	end
+end
+
+if redis.call('EXISTS', k.present) == 0 then
+	local function count(items, state)
+		for _, item in ipairs(items) do
+			redis.call('HINCRBY', k.present, item, 1)
+			if redis.call('EXISTS', metaKey(base, item)) == 0 then
+				setState(base, item, state, now)
+			end
+		end
+	end
+	for _, priority in ipairs(priorities()) do
+		count(redis.call('LRANGE', queuedKey(base, priority), 0, -1), 'queued')
+	end
+	count(redis.call('LRANGE', k.claimed, 0, -1), 'queued')
+	local scheduled = redis.call('ZRANGE', k.scheduled, 0, -1)
+	for i, member in ipairs(scheduled) do
+		scheduled[i] = scheduledItem(member)
+	end
+	count(scheduled, 'scheduled')
+	local tokens = redis.call('ZRANGE', k.pending, 0, -1)
+	for i, token in ipairs(tokens) do
+		tokens[i] = itemOf(token)
+	end
+	count(tokens, 'pending')
+end
+return n
+`)
+
+// removeScript takes every copy of items off the queued lists, the
+// scheduled set or both. Items that leave the queue for good lose their
+// attempt count, priority, payload and metadata. Returns the number of
+// copies removed.
+// ARGV: queue key prefix, where ("queued", "scheduled" or "all"), items...
+var removeScript = newQueueScript(metaLua + queuedLua + scheduledLua + presentLua + `
+local base, where = ARGV[1], ARGV[2]
+local unscheduled = {}
+if where ~= 'queued' then
+	for i = 3, #ARGV do
+		unscheduled[ARGV[i]] = 0
+	end
+	for _, member in ipairs(redis.call('ZRANGE', k.scheduled, 0, -1)) do
+		local item = scheduledItem(member)
+		if unscheduled[item] then
+			redis.call('ZREM', k.scheduled, member)
+			unscheduled[item] = unscheduled[item] + 1
+		end
+	end
+end
+local removed = 0
+for i = 3, #ARGV do
+	local item = ARGV[i]
+	local n = unscheduled[item] or 0
+	unscheduled[item] = 0
+	if where ~= 'scheduled' then
+		local priority = tonumber(redis.call('HGET', k.priority, item)) or 0
+		n = n + redis.call('LREM', queuedKey(base, priority), 0, item)
+	end
+	for j = 1, n do
+		if leave(item) then
+			redis.call('HDEL', k.attempts, item)
+			redis.call('HDEL', k.priority, item)
+			redis.call('HDEL', k.payloads, item)
+			redis.call('DEL', metaKey(base, item))
+		end
+	end
+	removed = removed + n
+end
+return removed
+`)
+
+// settingsScript replaces the settings of a queue. With create set, it
+// creates the queue by setting its marker, and returns 0 if it exists
+// already. Otherwise it returns 0 if there is no such queue. The caller
+// registers it.
+// ARGV: queue key prefix, create ("1" or ""), field and value pairs...
+var settingsScript = newQueueScript(`
+local exists = redis.call('EXISTS', k.created) == 1
+if exists == (ARGV[2] == '1') then
+	return 0
+end
+redis.call('SET', k.created, 1)
+redis.call('HMSET', k.settings, unpack(ARGV, 3))
+return 1
+`)
+
+// deleteScript deletes every key of a queue, its marker first, down to its
+// lease counter and idempotency keys. Returns 0 if there is no such queue.
+// The caller unregisters it.
+// ARGV: queue key prefix.
+var deleteScript = newQueueScript(metaLua + leaseLua + queuedLua + scheduledLua + dropMetaLua + `
+local base = ARGV[1]
+if redis.call('DEL', k.created) == 0 then
+	return 0
+end
+dropMeta(base)
+for _, priority in ipairs(priorities()) do
+	redis.call('DEL', queuedKey(base, priority))
+end
+for _, name in ipairs(redis.call('ZRANGE', k.idempotency, 0, -1)) do
+	redis.call('DEL', base .. 'idempotency-' .. name)
+end
+redis.call('DEL', unpack(KEYS))
+return 1
+`)
+
+// bulkScript appends items to a queue, or schedules them if they are due
+// later, optionally clearing the queue first, down to its lease counter. A
+// queue that does not exist is created rather than cleared. Items the queue already holds are left out if
+// it dedupes, or else the whole batch is refused if it rejects duplicates.
+// Returns a status, ok or duplicate, and the items left out. The caller
+// registers the queue.
+// ARGV: queue key prefix, clear ("1" or ""), priority, due time or 0, now,
+// items...
+var bulkScript = newQueueScript(metaLua + leaseLua + queuedLua + scheduledLua + dropMetaLua + presentLua + `
+local base = ARGV[1]
+local clear = ARGV[2] == '1' and redis.call('EXISTS', k.created) == 1
+local mode = dedupeMode()
+local seen, fresh, duplicates = {}, {}, {}
+for i = 6, #ARGV do
+	local item = ARGV[i]
+	if mode ~= 'off' and (seen[item] or (not clear and held(item, ARGV[5]))) then
+		table.insert(duplicates, item)
+	else
+		seen[item] = true
+		table.insert(fresh, item)
+	end
+end
+if mode == 'reject' and #duplicates > 0 then
+	return {'duplicate', duplicates}
+end
+
+redis.call('SET', k.created, 1)
+if clear then
+	dropMeta(base)
+	for _, priority in ipairs(priorities()) do
+		redis.call('DEL', queuedKey(base, priority))
+	end
+	redis.call('DEL', k.pending, k.done, k.scheduled, k.attempts, k.dead, k.priorities, k.priority, k.payloads,
+		k.delivered, k.present, k.recent, k.leases)
+end
+for _, item in ipairs(fresh) do
+	setPriority(item, ARGV[3])
+	arrive(item)
+	setEnqueued(base, item, ARGV[5], ARGV[4])
+	if tonumber(ARGV[4]) > 0 then
+		schedule(item, ARGV[4])
+	else
+		append(base, item)
+	end
+end
+return {'ok', duplicates}
+`)
+
+// claimKeyScript claims an idempotency key for window seconds unless it is
+// held. Returns nil if it was claimed, or else the response saved under it,
+// "" while that is still in progress.
+// ARGV: queue key prefix, name, window, now.
+var claimKeyScript = newQueueScript(`
+redis.call('ZREMRANGEBYSCORE', k.idempotency, '-inf', ARGV[4])
+local key = ARGV[1] .. 'idempotency-' .. ARGV[2]
+if redis.call('SET', key, '', 'NX', 'EX', ARGV[3]) then
+	redis.call('ZADD', k.idempotency, ARGV[4] + ARGV[3], ARGV[2])
+	return false
+end
+return redis.call('GET', key)
+`)
+
+// saveKeyScript saves the response to a claimed idempotency key for window
+// seconds.
+// ARGV: queue key prefix, name, response, window, now.
+var saveKeyScript = newQueueScript(`
+if redis.call('SET', ARGV[1] .. 'idempotency-' .. ARGV[2], ARGV[3], 'XX', 'EX', ARGV[4]) then
+	redis.call('ZADD', k.idempotency, 'XX', ARGV[5] + ARGV[4], ARGV[2])
+end
+`)
+
+// forgetKeyScript drops a claimed idempotency key.
+// ARGV: queue key prefix, name.
+var forgetKeyScript = newQueueScript(`
+redis.call('DEL', ARGV[1] .. 'idempotency-' .. ARGV[2])
+redis.call('ZREM', k.idempotency, ARGV[2])
+`)
+
+// leaderScript takes or renews the reaper leader lease. Returns 1 if the
+// caller holds the lease.
+// KEYS: leader key. ARGV: holder id, lease milliseconds.
+var leaderScript = redis.NewScript(1, `
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return 1
+end
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+var scripts = []*redis.Script{
+	enqueueScript,
+	nextScript,
+	claimScript,
+	doneScript,
+	extendScript,
+	ttlScript,
+	expireScript,
+	releaseScript,
+	requeueScript,
+	redriveScript,
+	migrateScript,
+	removeScript,
+	settingsScript,
+	deleteScript,
+	bulkScript,
+	claimKeyScript,
+	saveKeyScript,
+	forgetKeyScript,
+	leaderScript,
+}
+
+// loadScripts loads all scripts into the script cache so that later calls
+// only need to send the hash.
+func loadScripts(r redis.Conn) error {
+	for _, script := range scripts {
+		if err := script.Load(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package store
+
+import (
+	"fmt"
+)
+
+// DefaultLease is the lease in seconds of queues without their own settings.
+const DefaultLease = 300
+
+// LeaseLimit bounds in seconds every lease and extension, whatever the
+// settings of the queue.
+const LeaseLimit = 86400
+
+// Settings are the per-queue settings. Lease is the lease given by Next,
+// MaxLease bounds the lease a worker may hold and MaxExtend bounds how far
+// Extend pushes a lease, both within LeaseLimit. MaxAttempts is how many
+// deliveries an item gets before it goes to the dead list. A zero maximum
+// means no limit, short of LeaseLimit for leases.
+//
+// Items that expire or are released wait Backoff seconds before they are
+// queued again, multiplied by BackoffFactor, which may be fractional, for
+// every delivery after the first and capped at BackoffMax. BackoffJitter
+// randomizes the wait by up to that percentage either way. A zero Backoff
+// requeues items at once.
+//
+// Order is the order in which Next serves queued items, one of OrderFIFO,
+// OrderLIFO and OrderRandom. It is chosen when the queue is created.
+//
+// Dedupe is what enqueueing an item the queue already holds does: nothing
+// special with DedupeOff, an error with DedupeReject and nothing at all with
+// DedupeIgnore. A queue holds the items that are queued, scheduled or
+// pending, and the items done in the last DedupeWindow seconds.
+//
+// Responses to requests with an Idempotency-Key header are remembered for
+// IdempotencyWindow seconds, or not at all if it is zero.
+type Settings struct {
+	Lease             int
+	MaxLease          int
+	MaxExtend         int
+	MaxAttempts       int
+	Backoff           int
+	BackoffFactor     float64
+	BackoffMax        int
+	BackoffJitter     int
+	Order             string
+	Dedupe            string
+	DedupeWindow      int
+	IdempotencyWindow int
+}
+
+// Orders of a queue.
+const (
+	OrderFIFO   = "fifo"
+	OrderLIFO   = "lifo"
+	OrderRandom = "random"
+)
+
+// Dedupe modes of a queue.
+const (
+	DedupeOff    = "off"
+	DedupeReject = "reject"
+	DedupeIgnore = "ignore"
+)
+
+// DefaultSettings apply to queues created without settings, including
+// queues created before settings existed.
+var DefaultSettings = Settings{Lease: DefaultLease, BackoffFactor: 2, Order: OrderFIFO, Dedupe: DedupeOff,
+	IdempotencyWindow: 86400}
+
+// Fields returns the whole number settings by name. BackoffFactor is kept
+// as "backoff_factor" apart.
+func (s *Settings) Fields() map[string]*int {
+	return map[string]*int{
+		"lease":              &s.Lease,
+		"max_lease":          &s.MaxLease,
+		"max_extend":         &s.MaxExtend,
+		"max_attempts":       &s.MaxAttempts,
+		"backoff":            &s.Backoff,
+		"backoff_max":        &s.BackoffMax,
+		"backoff_jitter":     &s.BackoffJitter,
+		"dedupe_window":      &s.DedupeWindow,
+		"idempotency_window": &s.IdempotencyWindow,
+	}
+}
+
+// NextLease returns the seconds of a lease given by Next when the worker
+// asked for requested seconds, or 0 for the queue's default.
+func (s Settings) NextLease(requested int) int {
+	return bound(requested, s.Lease, s.MaxLease)
+}
+
+// Extension returns the seconds Extend gives a lease when the worker asked
+// for requested seconds, or 0 for the queue's default.
+func (s Settings) Extension(requested int) int {
+	return bound(requested, s.Lease, s.MaxExtend)
+}
+
+func bound(requested, fallback, max int) int {
+	if requested == 0 {
+		requested = fallback
+	}
+	if max == 0 || max > LeaseLimit {
+		max = LeaseLimit
+	}
+	if requested > max {
+		return max
+	}
+	return requested
+}
+
+func (s Settings) String() string {
+	return fmt.Sprintf("Lease: %d. Max lease: %d. Max extend: %d. Max attempts: %d. "+
+		"Backoff: %d. Backoff factor: %g. Backoff max: %d. Backoff jitter: %d. Order: %s. "+
+		"Dedupe: %s. Dedupe window: %d. Idempotency window: %d.",
+		s.Lease, s.MaxLease, s.MaxExtend, s.MaxAttempts,
+		s.Backoff, s.BackoffFactor, s.BackoffMax, s.BackoffJitter, s.Order,
+		s.Dedupe, s.DedupeWindow, s.IdempotencyWindow)
+}
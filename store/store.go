@@ -0,0 +1,183 @@
+// Package store keeps queues and the items in them, with the semantics the
+// HTTP handlers rely on: items are queued, leased to workers as pending,
+// done, scheduled for later or dead once they run out of attempts.
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+// Store is where queues live. Every method that changes a queue does so
+// all-or-nothing.
+type Store interface {
+	// Queues returns the ids of all queues.
+	Queues() ([]string, error)
+	// Exists tells whether a queue exists.
+	Exists(qid string) (bool, error)
+	// CreateQueue creates a queue with the given settings. Returns false if
+	// it already exists.
+	CreateQueue(qid string, settings Settings) (bool, error)
+	// DeleteQueue deletes a queue and every item it holds. Returns false if
+	// there is no such queue.
+	DeleteQueue(qid string) (bool, error)
+	// Settings returns the settings of a queue, the defaults for a queue
+	// that has none.
+	Settings(qid string) (Settings, error)
+	// SaveSettings replaces the settings of a queue.
+	SaveSettings(qid string, settings Settings) error
+
+	// Enqueue adds an item to a queue. Returns StatusOK, StatusMissing if
+	// there is no such queue, or StatusDuplicate or StatusIgnored if the
+	// queue dedupes and already holds the item.
+	Enqueue(qid string, entry Entry) (string, error)
+	// Bulk registers a queue if needed and adds items to it, all with the
+	// given priority and due time, clearing the queue first if asked to.
+	// Returns StatusOK and the items left out as duplicates, or
+	// StatusDuplicate if the queue rejects duplicates and none were added.
+	Bulk(qid string, items []string, priority int, due int64, clear bool) (string, []string, error)
+	// Next leases up to count queued items to the worker at ip for the given
+	// seconds, highest priority first.
+	Next(qid, ip string, seconds, count int) ([]Lease, error)
+	// Wait blocks up to wait for an item to arrive on an empty queue and
+	// leases it as Next does. Returns no lease if none arrived in time or
+	// cancel was closed.
+	Wait(qid, ip string, seconds int, wait time.Duration, cancel <-chan bool) ([]Lease, error)
+	// Done completes leased items. Returns the status of each.
+	Done(qid string, leases []Lease) ([]string, error)
+	// Extend gives leased items the given seconds from now. Returns the
+	// status of each.
+	Extend(qid string, seconds int, leases []Lease) ([]string, error)
+	// TTL returns the seconds left on a lease, or a negative number if there
+	// is no lease. Returns ErrConflict if the item is leased under another
+	// token.
+	TTL(qid, item, token string) (int, error)
+	// Expire ends a lease so that the next reap requeues the item. Returns
+	// false if there is no lease, and ErrConflict as TTL does.
+	Expire(qid, item, token string) (bool, error)
+	// Release gives a leased item back to the queue, at the head or the
+	// tail, or scheduled at due if it is not 0. Returns the status of the
+	// item.
+	Release(qid, item, token string, head bool, due int64) (string, error)
+	// Redrive moves every dead item back to queued. Returns how many moved.
+	Redrive(qid string) (int, error)
+	// Remove takes every copy of items off the queue, from RemoveQueued,
+	// RemoveScheduled or RemoveAll. Returns the number of copies removed.
+	Remove(qid, where string, items []string) (int, error)
+	// Purge removes the items that match as Remove does.
+	Purge(qid, where string, match func(string) bool) (int, error)
+
+	// Lead takes or renews the reaper leader lease for holder. Returns true
+	// if holder leads.
+	Lead(holder string, lease time.Duration) (bool, error)
+	// Reap gives expired leases of a queue back to the queue, and queues
+	// scheduled items that are due. Returns the items requeued and the
+	// items moved to dead.
+	Reap(qid string) ([]string, []string, error)
+
+	// Stats counts the items of a queue.
+	Stats(qid string) (Stats, error)
+	// List returns the items of a queue in StateQueued, StateDone or
+	// StateDead. Queued items are listed by priority, highest first, each
+	// priority from the item served last to the item served next.
+	List(qid, state string) ([]string, error)
+	// Pending returns the leased items of a queue.
+	Pending(qid string) ([]PendingItem, error)
+	// Scheduled returns the scheduled items of a queue, soonest first.
+	Scheduled(qid string) ([]ScheduledItem, error)
+	// Item returns where an item is. Returns ErrNotFound if the queue knows
+	// nothing about it.
+	Item(qid, item string) (*ItemInfo, error)
+
+	// ClaimIdempotencyKey marks the idempotency key name of a queue as in
+	// progress for window seconds. If it was already claimed, it returns
+	// false and the response saved under it, empty while that is still in
+	// progress.
+	ClaimIdempotencyKey(qid, name string, window int) ([]byte, bool, error)
+	// SaveIdempotencyKey saves the response to a claimed key.
+	SaveIdempotencyKey(qid, name string, response []byte, window int) error
+	// ForgetIdempotencyKey drops a claimed key so the request can be retried.
+	ForgetIdempotencyKey(qid, name string) error
+
+	Close() error
+}
+
+// Entry is an item to enqueue. Payload is optional. Due is the unix time the
+// item becomes available, or 0 for right away.
+type Entry struct {
+	Item     string
+	Payload  string
+	Priority int
+	Due      int64
+}
+
+// Lease is an item leased by Next, or the item and token a worker gives to
+// Done or Extend. Payload is only set by Next.
+type Lease struct {
+	Item    string
+	Token   string
+	Payload string
+}
+
+// Stats are the item counts of a queue. ByPriority counts the queued items
+// of each priority in use, highest first.
+type Stats struct {
+	Done       int
+	Pending    int
+	Queued     int
+	Dead       int
+	ByPriority []PriorityCount
+}
+
+type PriorityCount struct {
+	Priority int
+	Count    int
+}
+
+// PendingItem is a leased item with the ip of the worker holding it and the
+// seconds left on the lease.
+type PendingItem struct {
+	Item string
+	IP   string
+	TTL  int
+}
+
+// ScheduledItem is an item waiting until it is due.
+type ScheduledItem struct {
+	Item string
+	Due  time.Time
+}
+
+// Statuses of an item given to Enqueue, Bulk, Done, Extend or Release.
+const (
+	StatusOK           = "ok"
+	StatusNotPending   = "not pending"
+	StatusLeaseExpired = "lease expired"
+	StatusConflict     = "conflict"
+	StatusDuplicate    = "duplicate"
+	StatusIgnored      = "ignored"
+	StatusMissing      = "missing"
+)
+
+// States of an item.
+const (
+	StateQueued    = "queued"
+	StateScheduled = "scheduled"
+	StatePending   = "pending"
+	StateDone      = "done"
+	StateDead      = "dead"
+)
+
+// Where Remove and Purge look for items.
+const (
+	RemoveQueued    = "queued"
+	RemoveScheduled = "scheduled"
+	RemoveAll       = "all"
+)
+
+var (
+	// ErrConflict is returned when a lease is held under another token.
+	ErrConflict = errors.New("lease token mismatch")
+	// ErrNotFound is returned by Item for unknown items.
+	ErrNotFound = errors.New("item not found")
+)
@@ -1,5 +1,6 @@
 import requests
 import sys
+import threading
 import time
 
 # api_base = sys.argv[1]
@@ -33,7 +34,20 @@ assert(r.status_code == 200)
 
 r = requests.get(api_base + "/show/" + qid)
 assert(r.status_code == 200)
-assert(r.content.strip() == "Done: 0. Pending: 0. Queued: 0. All: 0.")
+assert(r.content.strip() == "Done: 0. Pending: 0. Queued: 0. Dead: 0. All: 0.")
+
+r = requests.get(api_base + "/settings/" + qid)
+assert(r.status_code == 200)
+assert(r.content.strip() == "Lease: 300. Max lease: 0. Max extend: 0. Max attempts: 0. " +
+    "Backoff: 0. Backoff factor: 2. Backoff max: 0. Backoff jitter: 0. Order: fifo. " +
+    "Dedupe: off. Dedupe window: 0. Idempotency window: 86400.")
+r = requests.post(api_base + "/settings/" + qid, data={"lease": "600", "max_lease": "60"})
+assert(r.status_code == 400)
+r = requests.post(api_base + "/settings/" + qid, data={"max_extend": "600"})
+assert(r.status_code == 200)
+assert(r.content.strip() == "Lease: 300. Max lease: 0. Max extend: 600. Max attempts: 0. " +
+    "Backoff: 0. Backoff factor: 2. Backoff max: 0. Backoff jitter: 0. Order: fifo. " +
+    "Dedupe: off. Dedupe window: 0. Idempotency window: 86400.")
 
 r = requests.post(api_base + "/enqueue/" + qid, data={"item": "x1"})
 assert(r.status_code == 200)
@@ -46,29 +60,33 @@ assert(r.status_code == 200)
 
 r = requests.get(api_base + "/show/" + qid)
 assert(r.status_code == 200)
-assert(r.content.strip() == "Done: 0. Pending: 0. Queued: 4. All: 4.")
+assert(r.content.strip() == "Done: 0. Pending: 0. Queued: 4. Dead: 0. All: 4.")
 
 r = requests.post(api_base + "/next/" + qid)
 assert(r.status_code == 200)
 popped = r.content.strip()
 assert(len(popped) > 0)
+token = r.headers["X-Lease-Token"]
 
-r = requests.post(api_base + "/ttl/" + qid, data={"item": popped})
+r = requests.post(api_base + "/ttl/" + qid, data={"item": popped, "token": token})
 assert(r.status_code == 200)
 print r.content
 
+r = requests.post(api_base + "/ttl/" + qid, data={"item": popped, "token": "stale"})
+assert(r.status_code == 409)
+
 time.sleep(5)
 
 r = requests.get(api_base + "/show/" + qid + "/pending")
 assert(r.status_code == 200)
 print r.content
 
-r = requests.post(api_base + "/ttl/" + qid, data={"item": popped})
+r = requests.post(api_base + "/ttl/" + qid, data={"item": popped, "token": token})
 assert(r.status_code == 200)
 print r.content
 assert(int(r.content.strip()) <= 300 - 5)
 
-r = requests.post(api_base + "/expire/" + qid, data={"item": popped})
+r = requests.post(api_base + "/expire/" + qid, data={"item": popped, "token": token})
 assert(r.status_code == 200)
 
 time.sleep(10)
@@ -82,38 +100,409 @@ r = requests.post(api_base + "/next/" + qid)
 assert(r.status_code == 200)
 p1 = r.content.strip()
 assert(len(p1) > 0)
+t1 = r.headers["X-Lease-Token"]
 
 r = requests.post(api_base + "/next/" + qid)
 assert(r.status_code == 200)
 p2 = r.content.strip()
 assert(len(p2) > 0)
+t2 = r.headers["X-Lease-Token"]
 
 r = requests.post(api_base + "/next/" + qid)
 assert(r.status_code == 200)
 p3 = r.content.strip()
 assert(len(p3) > 0)
+t3 = r.headers["X-Lease-Token"]
 
 r = requests.post(api_base + "/next/" + qid)
 assert(r.status_code == 200)
 p4 = r.content.strip()
 assert(len(p4) > 0)
+t4 = r.headers["X-Lease-Token"]
 
 r = requests.post(api_base + "/next/" + qid)
 assert(r.status_code == 200)
 empty = r.content.strip()
 assert(len(empty) == 0)
 
-r = requests.post(api_base + "/done/" + qid, data={"item": p1})
+r = requests.post(api_base + "/done/" + qid, data={"item": p1, "token": token})
+assert(r.status_code == 409)
+
+r = requests.post(api_base + "/done/" + qid, data={"item": p1, "token": t1})
 assert(r.status_code == 200)
 
 r = requests.get(api_base + "/show/" + qid)
 assert(r.status_code == 200)
-assert(r.content.strip() == "Done: 1. Pending: 3. Queued: 0. All: 4.")
+assert(r.content.strip() == "Done: 1. Pending: 3. Queued: 0. Dead: 0. All: 4.")
 
 time.sleep(5)
-r = requests.post(api_base + "/extend/" + qid, data={"item": p1})
+r = requests.post(api_base + "/extend/" + qid, data={"item": p1, "token": t1})
+assert(r.status_code == 400)
+
+r = requests.post(api_base + "/extend/" + qid, data={"item": p2, "token": t2})
 assert(r.status_code == 200)
 
-r = requests.post(api_base + "/ttl/" + qid, data={"item": p1})
+r = requests.post(api_base + "/ttl/" + qid, data={"item": p2, "token": t2})
 assert(r.status_code == 200)
 assert(int(r.content.strip()) > 300-5)
+
+
+r = requests.post(api_base + "/extend/" + qid, data={"item": p3, "token": t3, "lease": "1000"})
+assert(r.status_code == 200)
+assert("X-Lease-Deadline" in r.headers)
+
+r = requests.post(api_base + "/ttl/" + qid, data={"item": p3, "token": t3})
+assert(r.status_code == 200)
+assert(600-5 < int(r.content.strip()) <= 600)
+
+r = requests.post(api_base + "/bulk/" + qid, data="b1\nb2\nb3\n")
+assert(r.status_code == 200)
+
+r = requests.post(api_base + "/next/" + qid + "?count=5")
+assert(r.status_code == 200)
+batch = [line.split("\t") for line in r.content.splitlines()]
+assert(sorted(item for item, token in batch) == ["b1", "b2", "b3"])
+leased = r.content
+
+r = requests.post(api_base + "/next/" + qid + "?count=5")
+assert(r.status_code == 200)
+assert(r.content.strip() == "")
+
+r = requests.post(api_base + "/extend/" + qid + "/bulk", data=leased + "\nb4\tb4:0")
+assert(r.status_code == 200)
+statuses = dict(line.split("\t") for line in r.content.splitlines())
+assert(statuses == {"b1": "ok", "b2": "ok", "b3": "ok", "b4": "not pending"})
+
+r = requests.post(api_base + "/done/" + qid + "/bulk", data=leased)
+assert(r.status_code == 200)
+assert(set(r.content.splitlines()) == {"b1\tok", "b2\tok", "b3\tok"})
+
+r = requests.post(api_base + "/enqueue/" + qid, data={"item": "n1"})
+assert(r.status_code == 200)
+r = requests.post(api_base + "/next/" + qid)
+assert(r.status_code == 200)
+assert(r.content.strip() == "n1")
+token = r.headers["X-Lease-Token"]
+
+r = requests.post(api_base + "/release/" + qid, data={"item": "n1", "token": "stale"})
+assert(r.status_code == 409)
+r = requests.post(api_base + "/release/" + qid, data={"item": "n1", "token": token})
+assert(r.status_code == 200)
+r = requests.post(api_base + "/release/" + qid, data={"item": "n1", "token": token})
+assert(r.status_code == 400)
+
+r = requests.post(api_base + "/next/" + qid)
+assert(r.status_code == 200)
+assert(r.content.strip() == "n1")
+token = r.headers["X-Lease-Token"]
+
+r = requests.post(api_base + "/release/" + qid, data={"item": "n1", "token": token, "delay": "3"})
+assert(r.status_code == 200)
+r = requests.post(api_base + "/next/" + qid)
+assert(r.status_code == 200)
+assert(r.content.strip() == "")
+
+time.sleep(10)
+r = requests.post(api_base + "/next/" + qid)
+assert(r.status_code == 200)
+assert(r.content.strip() == "n1")
+
+token = r.headers["X-Lease-Token"]
+r = requests.post(api_base + "/settings/" + qid, data={"max_attempts": "3"})
+assert(r.status_code == 200)
+r = requests.post(api_base + "/release/" + qid, data={"item": "n1", "token": token})
+assert(r.status_code == 200)
+
+r = requests.get(api_base + "/show/" + qid + "/dead")
+assert(r.status_code == 200)
+assert(r.content.strip() == "n1")
+
+r = requests.post(api_base + "/redrive/" + qid)
+assert(r.status_code == 200)
+assert(r.content.strip() == "1")
+
+r = requests.post(api_base + "/next/" + qid)
+assert(r.status_code == 200)
+assert(r.content.strip() == "n1")
+
+token = r.headers["X-Lease-Token"]
+r = requests.post(api_base + "/settings/" + qid, data={"max_attempts": "0", "backoff": "60"})
+assert(r.status_code == 200)
+r = requests.post(api_base + "/release/" + qid, data={"item": "n1", "token": token})
+assert(r.status_code == 200)
+
+r = requests.get(api_base + "/show/" + qid + "/scheduled")
+assert(r.status_code == 200)
+assert(r.content.startswith("n1\t"))
+
+r = requests.post(api_base + "/bulk/" + qid + "?delay=3", data="s1\ns2")
+assert(r.status_code == 200)
+r = requests.post(api_base + "/enqueue/" + qid, data={"item": "s3", "at": "2999-01-01T00:00:00Z"})
+assert(r.status_code == 200)
+
+r = requests.get(api_base + "/show/" + qid + "/scheduled")
+assert(r.status_code == 200)
+assert("s3\t2999-01-01T00:00:00Z" in r.content.splitlines())
+
+r = requests.post(api_base + "/next/" + qid)
+assert(r.status_code == 200)
+assert(r.content.strip() == "")
+
+time.sleep(10)
+r = requests.post(api_base + "/next/" + qid + "?count=5")
+assert(r.status_code == 200)
+assert(sorted(line.split("\t")[0] for line in r.content.splitlines()) == ["s1", "s2"])
+
+r = requests.post(api_base + "/enqueue/" + qid, data={"item": "p0"})
+assert(r.status_code == 200)
+r = requests.post(api_base + "/enqueue/" + qid, data={"item": "p5", "priority": "5"})
+assert(r.status_code == 200)
+r = requests.post(api_base + "/bulk/" + qid + "?priority=2", data="p2")
+assert(r.status_code == 200)
+r = requests.post(api_base + "/enqueue/" + qid, data={"item": "px", "priority": "high"})
+assert(r.status_code == 400)
+
+r = requests.get(api_base + "/show/" + qid)
+assert(r.status_code == 200)
+assert("Priority 5: 1. Priority 2: 1. Priority 0: 1." in r.content)
+
+r = requests.post(api_base + "/next/" + qid + "?count=3")
+assert(r.status_code == 200)
+assert([line.split("\t")[0] for line in r.content.splitlines()] == ["p5", "p2", "p0"])
+
+r = requests.post(api_base + "/new/" + qid + "-bad", data={"order": "sideways"})
+assert(r.status_code == 400)
+
+def served(order):
+    oqid = qid + "-" + order
+    r = requests.post(api_base + "/new/" + oqid, data={"order": order})
+    assert(r.status_code == 200)
+    r = requests.get(api_base + "/settings/" + oqid)
+    assert(("Order: " + order + ".") in r.content)
+    for item in ["o1", "o2"]:
+        r = requests.post(api_base + "/enqueue/" + oqid, data={"item": item})
+        assert(r.status_code == 200)
+    r = requests.post(api_base + "/bulk/" + oqid, data="o3\no4\no5")
+    assert(r.status_code == 200)
+    r = requests.post(api_base + "/next/" + oqid + "?count=10")
+    assert(r.status_code == 200)
+    items = [line.split("\t")[0] for line in r.content.splitlines()]
+    r = requests.post(api_base + "/delete/" + oqid)
+    assert(r.status_code == 200)
+    return items
+
+assert(served("fifo") == ["o1", "o2", "o3", "o4", "o5"])
+assert(served("lifo") == ["o5", "o4", "o3", "o2", "o1"])
+assert(sorted(served("random")) == ["o1", "o2", "o3", "o4", "o5"])
+
+pqid = qid + "-payloads"
+r = requests.post(api_base + "/new/" + pqid)
+assert(r.status_code == 200)
+r = requests.post(api_base + "/enqueue/" + pqid + "?id=job1", data="line one\nline two",
+                  headers={"Content-Type": "application/octet-stream"})
+assert(r.status_code == 200)
+assert(r.content == "job1")
+r = requests.post(api_base + "/enqueue/" + pqid, data={"payload": "{\"a\": 1}"})
+assert(r.status_code == 200)
+generated = r.content
+assert(len(generated) > 0)
+r = requests.post(api_base + "/enqueue/" + pqid, data={"item": ""})
+assert(r.status_code == 400)
+
+r = requests.post(api_base + "/next/" + pqid)
+assert(r.status_code == 200)
+assert(r.headers["X-Item-Id"] == "job1")
+assert(r.content == "line one\nline two")
+r = requests.post(api_base + "/done/" + pqid, data={"item": "job1", "token": r.headers["X-Lease-Token"]})
+assert(r.status_code == 200)
+
+r = requests.post(api_base + "/next/" + pqid + "?count=5", headers={"Accept": "application/json"})
+assert(r.status_code == 200)
+leases = r.json()
+assert(len(leases) == 1)
+assert(leases[0]["item"] == generated)
+assert(leases[0]["payload"].decode("base64") == "{\"a\": 1}")
+
+r = requests.post(api_base + "/delete/" + pqid)
+assert(r.status_code == 200)
+
+dqid = qid + "-dedupe"
+r = requests.post(api_base + "/new/" + dqid)
+assert(r.status_code == 200)
+r = requests.post(api_base + "/bulk/" + dqid, data="same\nsame")
+assert(r.status_code == 200)
+r = requests.post(api_base + "/next/" + dqid + "?count=2")
+assert(r.status_code == 200)
+leases = [line.split("\t") for line in r.content.splitlines()]
+assert([item for item, _ in leases] == ["same", "same"])
+assert(leases[0][1] != leases[1][1])
+r = requests.post(api_base + "/done/" + dqid + "/bulk", data=r.content)
+assert(r.status_code == 200)
+assert(r.content.strip() == "same\tok\nsame\tok")
+
+r = requests.post(api_base + "/settings/" + dqid, data={"dedupe": "reject"})
+assert(r.status_code == 200)
+r = requests.post(api_base + "/enqueue/" + dqid, data={"item": "d1"})
+assert(r.status_code == 200)
+r = requests.post(api_base + "/enqueue/" + dqid, data={"item": "d1"})
+assert(r.status_code == 409)
+r = requests.post(api_base + "/bulk/" + dqid, data="d1\nd2")
+assert(r.status_code == 409)
+assert(r.content.strip() == "d1")
+r = requests.post(api_base + "/next/" + dqid)
+assert(r.content.strip() == "d1")
+token = r.headers["X-Lease-Token"]
+r = requests.post(api_base + "/enqueue/" + dqid, data={"item": "d1"})
+assert(r.status_code == 409)
+
+r = requests.post(api_base + "/settings/" + dqid, data={"dedupe": "ignore", "dedupe_window": "60"})
+assert(r.status_code == 200)
+r = requests.post(api_base + "/done/" + dqid, data={"item": "d1", "token": token})
+assert(r.status_code == 200)
+r = requests.post(api_base + "/bulk/" + dqid, data="d1\nd2\nd2")
+assert(r.status_code == 200)
+assert(r.content.strip() == "d1\nd2")
+r = requests.get(api_base + "/show/" + dqid + "/queued")
+assert(r.content.strip() == "d2")
+
+r = requests.post(api_base + "/delete/" + dqid)
+assert(r.status_code == 200)
+
+iqid = qid + "-idempotency"
+r = requests.post(api_base + "/enqueue/" + iqid, data="payload", headers={"Idempotency-Key": "k1"})
+assert(r.status_code == 404)
+r = requests.post(api_base + "/new/" + iqid)
+assert(r.status_code == 200)
+r = requests.post(api_base + "/enqueue/" + iqid, data="payload", headers={"Idempotency-Key": "k1"})
+assert(r.status_code == 200)
+first = r.content
+r = requests.post(api_base + "/enqueue/" + iqid, data="payload", headers={"Idempotency-Key": "k1"})
+assert(r.status_code == 200)
+assert(r.content == first)
+assert(r.headers["Idempotent-Replayed"] == "true")
+r = requests.post(api_base + "/bulk/" + iqid, data="i1\ni2", headers={"Idempotency-Key": "k1"})
+assert(r.status_code == 200)
+r = requests.post(api_base + "/bulk/" + iqid, data="i1\ni2", headers={"Idempotency-Key": "k1"})
+assert(r.status_code == 200)
+r = requests.get(api_base + "/show/" + iqid)
+assert(r.content.strip() == "Done: 0. Pending: 0. Queued: 3. Dead: 0. All: 3.")
+
+r = requests.post(api_base + "/next/" + iqid)
+item, token = r.headers["X-Item-Id"], r.headers["X-Lease-Token"]
+r = requests.post(api_base + "/done/" + iqid, data={"item": item, "token": token}, headers={"Idempotency-Key": "d1"})
+assert(r.status_code == 200)
+r = requests.post(api_base + "/done/" + iqid, data={"item": item, "token": token}, headers={"Idempotency-Key": "d1"})
+assert(r.status_code == 200)
+
+r = requests.post(api_base + "/delete/" + iqid)
+assert(r.status_code == 200)
+
+sqid = qid + "-status"
+r = requests.post(api_base + "/new/" + sqid)
+assert(r.status_code == 200)
+r = requests.post(api_base + "/bulk/" + sqid, data="a\nb")
+assert(r.status_code == 200)
+r = requests.get(api_base + "/item/" + sqid + "/b", headers={"Accept": "application/json"})
+assert(r.status_code == 200)
+info = r.json()
+assert(info["state"] == "queued")
+assert(info["position"] == 1)
+assert("enqueued" in info)
+
+r = requests.post(api_base + "/next/" + sqid)
+assert(r.content.strip() == "a")
+token = r.headers["X-Lease-Token"]
+r = requests.get(api_base + "/item/" + sqid + "/a", headers={"Accept": "application/json"})
+info = r.json()
+assert(info["state"] == "pending")
+assert(info["attempts"] == 1)
+assert(len(info["leaseholder"]) > 0)
+assert(0 < info["ttl"] <= 300)
+
+r = requests.post(api_base + "/done/" + sqid, data={"item": "a", "token": token})
+assert(r.status_code == 200)
+r = requests.get(api_base + "/item/" + sqid + "/a")
+assert(r.status_code == 200)
+assert(r.content.startswith("State: done."))
+assert("Completed: " in r.content)
+
+r = requests.get(api_base + "/item/" + sqid + "/nope")
+assert(r.status_code == 404)
+
+r = requests.post(api_base + "/enqueue/" + sqid, data={"item": "http://example.com/a/b"})
+assert(r.status_code == 200)
+r = requests.get(api_base + "/item/" + sqid + "/http://example.com/a/b")
+assert(r.status_code == 200)
+assert(r.content.startswith("State: queued."))
+r = requests.post(api_base + "/delete/" + sqid)
+assert(r.status_code == 200)
+
+rqid = qid + "-remove"
+r = requests.post(api_base + "/new/" + rqid)
+assert(r.status_code == 200)
+r = requests.post(api_base + "/bulk/" + rqid, data="keep\ndrop1\ndrop1\njob-1\njob-2")
+assert(r.status_code == 200)
+r = requests.post(api_base + "/enqueue/" + rqid, data={"item": "job-3", "delay": "600"})
+assert(r.status_code == 200)
+
+r = requests.post(api_base + "/remove/" + rqid, data="drop1\nmissing")
+assert(r.status_code == 200)
+assert(r.content.strip() == "2")
+r = requests.post(api_base + "/purge/" + rqid, data={"prefix": "job-", "from": "queued"})
+assert(r.status_code == 200)
+assert(r.content.strip() == "2")
+r = requests.post(api_base + "/purge/" + rqid, data={"regex": "^job-\\d$"})
+assert(r.status_code == 200)
+assert(r.content.strip() == "1")
+r = requests.post(api_base + "/purge/" + rqid, data={"regex": "("})
+assert(r.status_code == 400)
+
+r = requests.get(api_base + "/show/" + rqid + "/queued")
+assert(r.content.strip() == "keep")
+r = requests.get(api_base + "/show/" + rqid + "/scheduled")
+assert(r.content.strip() == "")
+r = requests.post(api_base + "/delete/" + rqid)
+assert(r.status_code == 200)
+
+cqid = qid + "-copies"
+r = requests.post(api_base + "/new/" + cqid)
+assert(r.status_code == 200)
+r = requests.post(api_base + "/bulk/" + cqid + "?delay=2", data="z\nz")
+assert(r.status_code == 200)
+r = requests.post(api_base + "/enqueue/" + cqid, data={"item": "z", "delay": "600"})
+assert(r.status_code == 200)
+r = requests.get(api_base + "/show/" + cqid + "/scheduled")
+assert(r.status_code == 200)
+assert([line.split("\t")[0] for line in r.content.strip().splitlines()] == ["z", "z", "z"])
+
+time.sleep(10)
+r = requests.get(api_base + "/show/" + cqid)
+assert(r.content.strip() == "Done: 0. Pending: 0. Queued: 2. Dead: 0. All: 2.")
+r = requests.post(api_base + "/remove/" + cqid + "?from=scheduled", data="z")
+assert(r.status_code == 200)
+assert(r.content.strip() == "1")
+r = requests.post(api_base + "/delete/" + cqid)
+assert(r.status_code == 200)
+
+wqid = qid + "-wait"
+r = requests.post(api_base + "/new/" + wqid)
+assert(r.status_code == 200)
+
+start = time.time()
+r = requests.post(api_base + "/next/" + wqid, data={"wait": "1"})
+assert(r.status_code == 200)
+assert(r.content.strip() == "")
+assert(time.time() - start >= 1)
+
+def enqueue_later():
+    time.sleep(1)
+    requests.post(api_base + "/enqueue/" + wqid, data={"item": "w1"})
+threading.Thread(target=enqueue_later).start()
+start = time.time()
+r = requests.post(api_base + "/next/" + wqid, data={"wait": "10"})
+assert(r.status_code == 200)
+assert(r.content.strip() == "w1")
+assert(time.time() - start < 10)
+
+r = requests.post(api_base + "/delete/" + wqid)
+assert(r.status_code == 200)
@@ -2,22 +2,43 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"github.com/ccp0101/queues/store"
 	"github.com/garyburd/redigo/redis"
 	"github.com/gin-gonic/gin"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
-const Timeout = 300
+// MaxWait bounds the seconds /next holds a request waiting for an item.
+const MaxWait = 60
+
+// MaxBatch bounds the items a single /next may lease.
+const MaxBatch = 1000
+
+// lease is an item handed out by /next, as rendered in JSON. The payload is
+// base64 encoded as it may be binary.
+type lease struct {
+	Item     string `json:"item"`
+	Token    string `json:"token"`
+	Deadline string `json:"deadline"`
+	Payload  []byte `json:"payload,omitempty"`
+}
+
+// itemStatus is the outcome for one item of a bulk /done or /extend, as
+// rendered in JSON.
+type itemStatus struct {
+	Item   string `json:"item"`
+	Status string `json:"status"`
+}
 
 //ipRange - a structure that holds the start and end of a range of ip addresses
 type ipRange struct {
@@ -91,53 +112,148 @@ func GetClientIPAdress(r *http.Request) string {
 	return ""
 }
 
-func ParseRedistogoUrl() (string, string) {
-	redisUrl := os.Getenv("REDIS_URL")
-	redisInfo, _ := url.Parse(redisUrl)
-	server := redisInfo.Host
-	password := ""
-	if redisInfo.User != nil {
-		password, _ = redisInfo.User.Password()
+// openStore opens the store named by STORE: memory, file or redis. Without
+// STORE, queues are kept in Redis at REDIS_URL, or in memory if REDIS_URL is
+// unset. The file store keeps queues in STORE_DIR, "data" by default, and
+// compacts its log every COMPACT_INTERVAL.
+func openStore() (store.Store, error) {
+	kind := os.Getenv("STORE")
+	if kind == "" {
+		kind = "redis"
+		if os.Getenv("REDIS_URL") == "" {
+			kind = "memory"
+		}
+	}
+	log.Printf("Store: %v", kind)
+
+	switch kind {
+	case "memory":
+		return store.NewMemory(), nil
+	case "file":
+		return openFile()
+	case "redis":
+		return openRedis()
+	}
+	return nil, fmt.Errorf("unknown store %v", kind)
+}
+
+func openFile() (store.Store, error) {
+	dir := os.Getenv("STORE_DIR")
+	if dir == "" {
+		dir = "data"
+	}
+	compactInterval := time.Minute
+	if s := os.Getenv("COMPACT_INTERVAL"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, err
+		}
+		compactInterval = d
+	}
+	log.Printf("Store dir: %v. Compact interval: %v", dir, compactInterval)
+
+	queues, err := store.NewFile(dir, compactInterval)
+	if err != nil {
+		return nil, err
+	}
+	return queues, nil
+}
+
+// redisDial returns a dial for the Redis at REDIS_URL, as parseRedisURL
+// reads it.
+func redisDial() (func() (redis.Conn, error), error) {
+	options, err := parseRedisURL(os.Getenv("REDIS_URL"))
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Redis: %v. Database: %v. TLS: %v", options.address, options.db, options.tls != nil)
+	return options.dial, nil
+}
+
+// openRedis connects to the Redis at REDIS_URL.
+func openRedis() (store.Store, error) {
+	dial, err := redisDial()
+	if err != nil {
+		return nil, err
+	}
+
+	queues, err := store.NewRedis(dial)
+	if err == store.ErrOldKeys {
+		return nil, fmt.Errorf("%v; run \"queues migrate-keys\" first", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return queues, nil
+}
+
+// migrateKeys moves the keys of the queues at REDIS_URL from the layout of
+// older versions, for "queues migrate-keys".
+func migrateKeys() error {
+	dial, err := redisDial()
+	if err != nil {
+		return err
+	}
+	r, err := dial()
+	if err != nil {
+		return err
 	}
-	return server, password
+	defer r.Close()
+
+	moved, err := store.MigrateKeys(r)
+	log.Printf("Moved %v keys", moved)
+	return err
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate-keys" {
+		if err := migrateKeys(); err != nil {
+			panic(err)
+		}
+		return
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "17901"
 	}
 	log.Printf("Port: %v", port)
 
-	redisUrl, err := url.Parse(os.Getenv("REDIS_URL"))
-	if err != nil {
-		panic(err)
+	// Seeds the jitter of retry backoffs.
+	rand.Seed(time.Now().UnixNano())
+
+	reapInterval := 5 * time.Second
+	if s := os.Getenv("REAP_INTERVAL"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			panic(err)
+		}
+		reapInterval = d
 	}
+	log.Printf("Reap interval: %v", reapInterval)
 
-	db, err := strconv.Atoi(strings.TrimLeft(redisUrl.Path, "/"))
+	queues, err := openStore()
 	if err != nil {
 		panic(err)
 	}
+	defer queues.Close()
 
-	redisPool := redis.NewPool(func() (redis.Conn, error) {
-		c, err := redis.Dial("tcp", redisUrl.Host, redis.DialDatabase(db))
+	router := gin.Default()
 
+	queueExists := func(qid string) bool {
+		exists, err := queues.Exists(qid)
 		if err != nil {
-			return nil, err
+			panic(err)
 		}
+		return exists
+	}
 
-		return c, err
-	}, 10)
-	defer redisPool.Close()
-
-	router := gin.Default()
-
-	queueExists := func(r redis.Conn, qid string) bool {
-		isMember, err := redis.Bool(r.Do("SISMEMBER", "queues", qid))
+	loadSettings := func(qid string) store.Settings {
+		settings, err := queues.Settings(qid)
 		if err != nil {
 			panic(err)
 		}
-		return isMember
+		return settings
 	}
 
 	sanitizeQid := func(qid string) string {
@@ -158,91 +274,199 @@ func main() {
 		return item
 	}
 
+	// param returns a form value, falling back to the query string.
+	param := func(c *gin.Context, key string) string {
+		if value, ok := c.GetPostForm(key); ok {
+			return value
+		}
+		return c.Query(key)
+	}
+
+	// leaseParam returns the lease seconds a worker asked for, or 0 if it did
+	// not ask for any.
+	leaseParam := func(c *gin.Context) (int, bool) {
+		value := param(c, "lease")
+		if value == "" {
+			return 0, true
+		}
+		lease, err := strconv.Atoi(value)
+		return lease, err == nil && lease > 0
+	}
+
+	// dueParam returns when an item should become available, from either a
+	// delay in seconds or an RFC3339 time. It returns 0 for right away.
+	dueParam := func(c *gin.Context) (int64, error) {
+		delayValue, atValue := param(c, "delay"), param(c, "at")
+		now := time.Now()
+		var due time.Time
+		switch {
+		case delayValue != "" && atValue != "":
+			return 0, errors.New("delay and at must not both be given.")
+		case delayValue != "":
+			delay, err := strconv.Atoi(delayValue)
+			if err != nil || delay < 0 {
+				return 0, errors.New("delay must be a non-negative number.")
+			}
+			due = now.Add(time.Duration(delay) * time.Second)
+		case atValue != "":
+			at, err := time.Parse(time.RFC3339, atValue)
+			if err != nil {
+				return 0, errors.New("at must be an RFC3339 time.")
+			}
+			due = at
+		}
+		if !due.After(now) {
+			return 0, nil
+		}
+		return due.Unix(), nil
+	}
+
+	// priorityParam returns the priority of the items to enqueue, 0 if not
+	// given.
+	priorityParam := func(c *gin.Context) (int, bool) {
+		value := param(c, "priority")
+		if value == "" {
+			return 0, true
+		}
+		priority, err := strconv.Atoi(value)
+		return priority, err == nil
+	}
+
+	// parseLeases reads the "<item>\t<token>" lines of a bulk /done or
+	// /extend body, as returned by a batch /next.
+	parseLeases := func(body []byte) []store.Lease {
+		var leases []store.Lease
+		for _, line := range strings.Split(string(body), "\n") {
+			line = strings.Trim(line, " \r")
+			if line == "" {
+				continue
+			}
+			item, token := line, ""
+			if i := strings.LastIndex(line, "\t"); i >= 0 {
+				item, token = line[:i], line[i+1:]
+			}
+			leases = append(leases, store.Lease{Item: item, Token: token})
+		}
+		return leases
+	}
+
+	// parseItems reads the items of a body, one per line.
+	parseItems := func(body []byte) []string {
+		var items []string
+		for _, line := range strings.Split(string(body), "\n") {
+			item := strings.Trim(line, " \r\n")
+			if item != "" {
+				items = append(items, item)
+			}
+		}
+		return items
+	}
+
+	// renderStatuses writes the outcome of a bulk /done or /extend as
+	// "<item>\t<status>" lines, or as JSON if the client asks for it.
+	renderStatuses := func(c *gin.Context, leases []store.Lease, statuses []string) {
+		if c.NegotiateFormat(gin.MIMEPlain, gin.MIMEJSON) == gin.MIMEJSON {
+			output := make([]itemStatus, 0, len(leases))
+			for i, lease := range leases {
+				output = append(output, itemStatus{lease.Item, statuses[i]})
+			}
+			c.JSON(http.StatusOK, output)
+			return
+		}
+		output := make([]string, 0, len(leases))
+		for i, lease := range leases {
+			output = append(output, lease.Item+"\t"+statuses[i])
+		}
+		c.String(http.StatusOK, strings.Join(output, "\n"))
+	}
+
 	router.GET("/", func(c *gin.Context) {
 		c.String(http.StatusOK, "Sweet home!")
 	})
 
 	router.GET("/queues", func(c *gin.Context) {
-		r := redisPool.Get()
-		defer r.Close()
-		queues, err := redis.Strings(r.Do("SMEMBERS", "queues"))
+		qids, err := queues.Queues()
 		if err != nil {
 			panic(err)
 		}
 
-		c.String(http.StatusOK, strings.Join(queues, "\n"))
+		c.String(http.StatusOK, strings.Join(qids, "\n"))
 	})
 
 	router.GET("/show/:qid", func(c *gin.Context) {
-		r := redisPool.Get()
-		defer r.Close()
 		qid := sanitizeQid(c.Param("qid"))
 
-		if queueExists(r, qid) {
-			queued, err := redis.Int(r.Do("LLEN", "queues-"+qid+"-queued"))
-			if err != nil {
-				panic(err)
-			}
-			pending, err := redis.Int(r.Do("LLEN", "queues-"+qid+"-pending"))
+		if queueExists(qid) {
+			stats, err := queues.Stats(qid)
 			if err != nil {
 				panic(err)
 			}
-			done, err := redis.Int(r.Do("LLEN", "queues-"+qid+"-done"))
-			if err != nil {
-				panic(err)
+			byPriority := ""
+			if len(stats.ByPriority) > 1 {
+				for _, count := range stats.ByPriority {
+					byPriority += fmt.Sprintf("Priority %d: %d. ", count.Priority, count.Count)
+				}
 			}
-			c.String(http.StatusOK, "Done: %d. Pending: %d. Queued: %d. All: %d. ",
-				done, pending, queued, done+pending+queued)
+			c.String(http.StatusOK, "Done: %d. Pending: %d. Queued: %d. Dead: %d. All: %d. %s",
+				stats.Done, stats.Pending, stats.Queued, stats.Dead,
+				stats.Done+stats.Pending+stats.Queued+stats.Dead, byPriority)
 		} else {
 			c.String(http.StatusNotFound, "Queue "+qid+" does not exist.")
 		}
 	})
 
-	router.GET("/show/:qid/queued", func(c *gin.Context) {
-		r := redisPool.Get()
-		defer r.Close()
+	// list shows the items of a queue in a state, one per line.
+	list := func(state string) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			qid := sanitizeQid(c.Param("qid"))
+
+			if queueExists(qid) {
+				items, err := queues.List(qid, state)
+				if err != nil {
+					panic(err)
+				}
+				c.String(http.StatusOK, strings.Join(items, "\n"))
+			} else {
+				c.String(http.StatusNotFound, "Queue "+qid+" does not exist.")
+			}
+		}
+	}
+
+	router.GET("/show/:qid/queued", list(store.StateQueued))
+
+	router.GET("/show/:qid/pending", func(c *gin.Context) {
 		qid := sanitizeQid(c.Param("qid"))
 
-		if queueExists(r, qid) {
-			queued, err := redis.Strings(r.Do("LRANGE", "queues-"+qid+"-queued", 0, -1))
+		if queueExists(qid) {
+			pending, err := queues.Pending(qid)
 			if err != nil {
 				panic(err)
 			}
-			c.String(http.StatusOK, strings.Join(queued, "\n"))
+
+			output := make([]string, 0, len(pending))
+			for _, p := range pending {
+				output = append(output, fmt.Sprintf("%s\t%s\t%d", p.Item, p.IP, p.TTL))
+			}
+			c.String(http.StatusOK, strings.Join(output, "\n"))
 		} else {
 			c.String(http.StatusNotFound, "Queue "+qid+" does not exist.")
 		}
 	})
 
-	router.GET("/show/:qid/pending", func(c *gin.Context) {
-		r := redisPool.Get()
-		defer r.Close()
+	router.GET("/show/:qid/done", list(store.StateDone))
+
+	router.GET("/show/:qid/scheduled", func(c *gin.Context) {
 		qid := sanitizeQid(c.Param("qid"))
 
-		if queueExists(r, qid) {
-			pending, err := redis.Strings(r.Do("LRANGE", "queues-"+qid+"-pending", 0, -1))
+		if queueExists(qid) {
+			scheduled, err := queues.Scheduled(qid)
 			if err != nil {
 				panic(err)
 			}
 
-			output := make([]string, 0, len(pending))
-			ret := make(chan string, len(pending))
-			var wg sync.WaitGroup
-			for _, item := range pending {
-				wg.Add(1)
-				go func(item string) {
-					r := redisPool.Get()
-					defer r.Close()
-					defer wg.Done()
-					get, _ := redis.String(r.Do("Get", "queues-"+qid+"-item-"+item+"-time"))
-					ttl, _ := redis.Int(r.Do("TTL", "queues-"+qid+"-item-"+item+"-time"))
-					ret <- fmt.Sprintf("%s\t%s\t%d", item, get, ttl)
-				}(item)
-			}
-			wg.Wait()
-			close(ret)
-			for line := range ret {
-				output = append(output, line)
+			output := make([]string, 0, len(scheduled))
+			for _, s := range scheduled {
+				output = append(output, fmt.Sprintf("%s\t%s", s.Item, s.Due.UTC().Format(time.RFC3339)))
 			}
 			c.String(http.StatusOK, strings.Join(output, "\n"))
 		} else {
@@ -250,150 +474,362 @@ func main() {
 		}
 	})
 
-	router.GET("/show/:qid/done", func(c *gin.Context) {
-		r := redisPool.Get()
-		defer r.Close()
+	router.GET("/show/:qid/dead", list(store.StateDead))
+
+	// The item is the rest of the path, as items may hold slashes.
+	router.GET("/item/:qid/*item", func(c *gin.Context) {
+		qid := sanitizeQid(c.Param("qid"))
+		item := sanitizeItem(strings.TrimPrefix(c.Param("item"), "/"))
+
+		if !queueExists(qid) {
+			c.String(http.StatusNotFound, "Queue "+qid+" does not exist.")
+			return
+		}
+		info, err := queues.Item(qid, item)
+		if err == store.ErrNotFound {
+			c.String(http.StatusNotFound, "%v was not found.", item)
+			return
+		}
+		if err != nil {
+			panic(err)
+		}
+		if c.NegotiateFormat(gin.MIMEPlain, gin.MIMEJSON) == gin.MIMEJSON {
+			c.JSON(http.StatusOK, info)
+			return
+		}
+		c.String(http.StatusOK, info.String())
+	})
+
+	router.POST("/new/:qid", func(c *gin.Context) {
 		qid := sanitizeQid(c.Param("qid"))
 
-		if queueExists(r, qid) {
-			done, err := redis.Strings(r.Do("LRANGE", "queues-"+qid+"-done", 0, -1))
+		if !queueExists(qid) {
+			settings := store.DefaultSettings
+			if err := updateSettings(&settings, c); err != nil {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			}
+			if err := updateOrder(&settings, c); err != nil {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			}
+
+			created, err := queues.CreateQueue(qid, settings)
 			if err != nil {
 				panic(err)
 			}
-			c.String(http.StatusOK, strings.Join(done, "\n"))
+			if created {
+				c.String(http.StatusOK, "Queue "+qid+" created.")
+				return
+			}
+		}
+		c.String(http.StatusBadRequest, "Queue "+qid+" already exists.")
+	})
+
+	router.GET("/settings/:qid", func(c *gin.Context) {
+		qid := sanitizeQid(c.Param("qid"))
+
+		if queueExists(qid) {
+			c.String(http.StatusOK, loadSettings(qid).String())
 		} else {
 			c.String(http.StatusNotFound, "Queue "+qid+" does not exist.")
 		}
 	})
 
-	router.POST("/new/:qid", func(c *gin.Context) {
-		r := redisPool.Get()
-		defer r.Close()
+	router.POST("/settings/:qid", func(c *gin.Context) {
 		qid := sanitizeQid(c.Param("qid"))
 
-		if !queueExists(r, qid) {
-			_, err := r.Do("SADD", "queues", qid)
-			if err != nil {
+		if queueExists(qid) {
+			settings := loadSettings(qid)
+			if err := updateSettings(&settings, c); err != nil {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			}
+
+			if err := queues.SaveSettings(qid, settings); err != nil {
 				panic(err)
 			}
-			c.String(http.StatusOK, "Queue "+qid+" created.")
+			c.String(http.StatusOK, settings.String())
 		} else {
-			c.String(http.StatusBadRequest, "Queue "+qid+" already exists.")
+			c.String(http.StatusNotFound, "Queue "+qid+" does not exist.")
 		}
 	})
 
 	router.POST("/delete/:qid", func(c *gin.Context) {
-		r := redisPool.Get()
-		defer r.Close()
 		qid := sanitizeQid(c.Param("qid"))
 
-		if queueExists(r, qid) {
-			r.Send("MULTI")
-			r.Send("SREM", "queues", qid)
-			r.Send("DEL", "queues-"+qid+"-queued", "queues-"+qid+"-pending",
-				"queues-"+qid+"-done")
-			_, err := r.Do("EXEC")
-			if err != nil {
-				panic(err)
-			}
+		deleted, err := queues.DeleteQueue(qid)
+		if err != nil {
+			panic(err)
+		}
+		if deleted {
 			c.String(http.StatusOK, "Queue "+qid+" deleted.")
 		} else {
 			c.String(http.StatusNotFound, "Queue "+qid+" does not exist.")
 		}
 	})
 
-	router.POST("/enqueue/:qid", func(c *gin.Context) {
-		r := redisPool.Get()
-		defer r.Close()
+	router.POST("/enqueue/:qid", idempotent(queues), func(c *gin.Context) {
 		qid := sanitizeQid(c.Param("qid"))
-		item := sanitizeItem(c.PostForm("item"))
-		if !queueExists(r, qid) {
-			c.String(http.StatusNotFound, "Queue "+qid+" does not exist.")
-		} else {
-			_, err := r.Do("RPush", "queues-"+qid+"-queued", item)
-			if err != nil {
-				panic(err)
+		// An item is either given as the item form value, which is also its
+		// ID, or as a payload: the payload form value or else the request
+		// body, under the id parameter or a new ID.
+		item := c.PostForm("item")
+		payload := ""
+		if item == "" {
+			var ok bool
+			if payload, ok = c.GetPostForm("payload"); !ok {
+				body, _ := ioutil.ReadAll(c.Request.Body)
+				payload = string(body)
+			}
+			if payload == "" {
+				c.String(http.StatusBadRequest, "item or payload is required.")
+				return
+			}
+			item = param(c, "id")
+			if item == "" {
+				item = newItemID()
 			}
-			c.String(http.StatusOK, "")
+		}
+		item = sanitizeItem(item)
+		due, err := dueParam(c)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		priority, ok := priorityParam(c)
+		if !ok {
+			c.String(http.StatusBadRequest, "priority must be a number.")
+			return
+		}
+		status, err := queues.Enqueue(qid, store.Entry{Item: item, Payload: payload, Priority: priority, Due: due})
+		if err != nil {
+			panic(err)
+		}
+		switch status {
+		case store.StatusMissing:
+			c.String(http.StatusNotFound, "Queue "+qid+" does not exist.")
+		case store.StatusDuplicate:
+			c.String(http.StatusConflict, "%s is already queued.", item)
+		default:
+			c.String(http.StatusOK, item)
 		}
 	})
 
 	router.POST("/next/:qid", func(c *gin.Context) {
-		r := redisPool.Get()
-		defer r.Close()
 		qid := sanitizeQid(c.Param("qid"))
 
-		if !queueExists(r, qid) {
+		if !queueExists(qid) {
 			c.String(http.StatusNotFound, "Queue "+qid+" does not exist.")
 		} else {
-			item, err := redis.String(r.Do("RPOPLPUSH", "queues-"+qid+"-queued", "queues-"+qid+"-pending"))
-			if item == "" {
-				c.String(http.StatusOK, "")
+			requested, ok := leaseParam(c)
+			if !ok {
+				c.String(http.StatusBadRequest, "lease must be a positive number.")
+				return
+			}
+			seconds := loadSettings(qid).NextLease(requested)
+
+			var err error
+			wait := 0
+			if value := param(c, "wait"); value != "" {
+				wait, err = strconv.Atoi(value)
+				if err != nil || wait < 0 {
+					c.String(http.StatusBadRequest, "wait must be a non-negative number.")
+					return
+				}
+				if wait > MaxWait {
+					wait = MaxWait
+				}
+			}
+
+			count := 1
+			countValue := param(c, "count")
+			if countValue != "" {
+				count, err = strconv.Atoi(countValue)
+				if err != nil || count < 1 {
+					c.String(http.StatusBadRequest, "count must be a positive number.")
+					return
+				}
+				if count > MaxBatch {
+					count = MaxBatch
+				}
 			}
 
-			// ip, _, _ := net.SplitHostPort(c.Request.RemoteAddr)
+			// Workers that connect directly send no forwarding headers.
 			ip := GetClientIPAdress(c.Request)
-			r.Send("MULTI")
-			r.Send("SET", "queues-"+qid+"-item-"+item+"-time", ip)
-			r.Send("EXPIRE", "queues-"+qid+"-item-"+item+"-time", Timeout)
-			_, err = r.Do("EXEC")
+			if ip == "" {
+				ip, _, _ = net.SplitHostPort(c.Request.RemoteAddr)
+			}
+			next := func(count int) []store.Lease {
+				leases, err := queues.Next(qid, ip, seconds, count)
+				if err != nil {
+					panic(err)
+				}
+				return leases
+			}
 
-			if err != nil {
-				panic(err)
+			leases := next(count)
+			if len(leases) == 0 && wait > 0 {
+				leases, err = queues.Wait(qid, ip, seconds, time.Duration(wait)*time.Second,
+					c.Writer.CloseNotify())
+				if err != nil {
+					panic(err)
+				}
+				if len(leases) > 0 && count > 1 {
+					leases = append(leases, next(count-1)...)
+				}
 			}
-			c.String(http.StatusOK, item)
+			now := time.Now()
+			if len(leases) > 0 {
+				c.Header("X-Lease-Deadline", deadline(now, seconds))
+			}
+
+			// A single item is the response body, or its payload if it has
+			// one. Batches list items and tokens in text, payloads only in
+			// JSON.
+			if countValue == "" {
+				if len(leases) == 0 {
+					c.String(http.StatusOK, "")
+					return
+				}
+				c.Header("X-Lease-Token", leases[0].Token)
+				c.Header("X-Item-Id", leases[0].Item)
+				if leases[0].Payload != "" {
+					c.Data(http.StatusOK, "application/octet-stream", []byte(leases[0].Payload))
+					return
+				}
+				c.String(http.StatusOK, leases[0].Item)
+				return
+			}
+
+			if c.NegotiateFormat(gin.MIMEPlain, gin.MIMEJSON) == gin.MIMEJSON {
+				output := make([]lease, 0, len(leases))
+				for _, l := range leases {
+					output = append(output, lease{l.Item, l.Token, deadline(now, seconds), []byte(l.Payload)})
+				}
+				c.JSON(http.StatusOK, output)
+				return
+			}
+			output := make([]string, 0, len(leases))
+			for _, l := range leases {
+				output = append(output, l.Item+"\t"+l.Token)
+			}
+			c.String(http.StatusOK, strings.Join(output, "\n"))
 		}
 	})
 
-	router.POST("/done/:qid", func(c *gin.Context) {
-		r := redisPool.Get()
-		defer r.Close()
+	router.POST("/done/:qid", idempotent(queues), func(c *gin.Context) {
 		qid := sanitizeQid(c.Param("qid"))
 		item := sanitizeItem(c.PostForm("item"))
+		token := c.PostForm("token")
+		if token == "" {
+			c.String(http.StatusBadRequest, "token must be given.")
+			return
+		}
 
-		if !queueExists(r, qid) {
+		if !queueExists(qid) {
 			c.String(http.StatusNotFound, "Queue "+qid+" does not exist.")
 		} else {
-			deleted, err := redis.Int(r.Do("LREM", "queues-"+qid+"-pending", 1, item))
+			statuses, err := queues.Done(qid, []store.Lease{{Item: item, Token: token}})
 			if err != nil {
 				panic(err)
 			}
-			if deleted != 1 {
+			switch statuses[0] {
+			case store.StatusOK:
+				c.String(http.StatusOK, item)
+			case store.StatusNotPending:
 				c.String(http.StatusBadRequest, "%s was not in pending.", item)
-			} else {
-				_, err := r.Do("RPUSH", "queues-"+qid+"-done", item)
-				if err != nil {
-					panic(err)
-				}
+			case store.StatusLeaseExpired:
+				c.String(http.StatusConflict, "The lease on %s has expired.", item)
+			case store.StatusConflict:
+				c.String(http.StatusConflict, "%s is leased with another token.", item)
+			}
+		}
+	})
 
-				c.String(http.StatusOK, item)
+	router.POST("/done/:qid/bulk", idempotent(queues), func(c *gin.Context) {
+		qid := sanitizeQid(c.Param("qid"))
+		body, _ := ioutil.ReadAll(c.Request.Body)
+		leases := parseLeases(body)
+
+		if !queueExists(qid) {
+			c.String(http.StatusNotFound, "Queue "+qid+" does not exist.")
+		} else {
+			statuses, err := queues.Done(qid, leases)
+			if err != nil {
+				panic(err)
 			}
+			renderStatuses(c, leases, statuses)
 		}
 	})
 
 	router.POST("/extend/:qid", func(c *gin.Context) {
-		r := redisPool.Get()
-		defer r.Close()
 		qid := sanitizeQid(c.Param("qid"))
 		item := sanitizeItem(c.PostForm("item"))
+		token := c.PostForm("token")
+		if token == "" {
+			c.String(http.StatusBadRequest, "token must be given.")
+			return
+		}
+		requested, ok := leaseParam(c)
+		if !ok {
+			c.String(http.StatusBadRequest, "lease must be a positive number.")
+			return
+		}
 
-		exp, err := redis.Bool(r.Do("EXPIRE", "queues-"+qid+"-item-"+item+"-time", Timeout))
+		seconds := loadSettings(qid).Extension(requested)
+		now := time.Now()
+
+		statuses, err := queues.Extend(qid, seconds, []store.Lease{{Item: item, Token: token}})
 		if err != nil {
 			panic(err)
 		}
-		if !exp {
+		switch statuses[0] {
+		case store.StatusOK:
+			c.Header("X-Lease-Deadline", deadline(now, seconds))
+			c.String(http.StatusOK, item)
+		case store.StatusNotPending, store.StatusLeaseExpired:
 			c.String(http.StatusBadRequest, "%v was not found.", item)
+		case store.StatusConflict:
+			c.String(http.StatusConflict, "%s is leased with another token.", item)
 		}
-		c.String(http.StatusOK, item)
+	})
+
+	router.POST("/extend/:qid/bulk", func(c *gin.Context) {
+		qid := sanitizeQid(c.Param("qid"))
+		body, _ := ioutil.ReadAll(c.Request.Body)
+		leases := parseLeases(body)
+		requested, ok := leaseParam(c)
+		if !ok {
+			c.String(http.StatusBadRequest, "lease must be a positive number.")
+			return
+		}
+
+		seconds := loadSettings(qid).Extension(requested)
+		now := time.Now()
+
+		statuses, err := queues.Extend(qid, seconds, leases)
+		if err != nil {
+			panic(err)
+		}
+		c.Header("X-Lease-Deadline", deadline(now, seconds))
+		renderStatuses(c, leases, statuses)
 	})
 
 	router.POST("/ttl/:qid", func(c *gin.Context) {
-		r := redisPool.Get()
-		defer r.Close()
 		qid := sanitizeQid(c.Param("qid"))
 		item := sanitizeItem(c.PostForm("item"))
+		token := c.PostForm("token")
+		if token == "" {
+			c.String(http.StatusBadRequest, "token must be given.")
+			return
+		}
 
-		ttl, err := redis.Int(r.Do("TTL", "queues-"+qid+"-item-"+item+"-time"))
+		ttl, err := queues.TTL(qid, item, token)
+		if err == store.ErrConflict {
+			c.String(http.StatusConflict, "%s is leased with another token.", item)
+			return
+		}
 		if err != nil {
 			panic(err)
 		}
@@ -405,87 +841,161 @@ func main() {
 	})
 
 	router.POST("/expire/:qid", func(c *gin.Context) {
-		r := redisPool.Get()
-		defer r.Close()
 		qid := sanitizeQid(c.Param("qid"))
 		item := sanitizeItem(c.PostForm("item"))
+		token := c.PostForm("token")
+		if token == "" {
+			c.String(http.StatusBadRequest, "token must be given.")
+			return
+		}
 
-		_, err := r.Do("DEL", "queues-"+qid+"-item-"+item+"-time")
+		exp, err := queues.Expire(qid, item, token)
+		if err == store.ErrConflict {
+			c.String(http.StatusConflict, "%s is leased with another token.", item)
+			return
+		}
 		if err != nil {
 			panic(err)
 		}
+		if !exp {
+			c.String(http.StatusBadRequest, "%v was not found.", item)
+			return
+		}
 		c.String(http.StatusOK, item)
 	})
 
-	router.POST("/_clean", func(c *gin.Context) {
-		r := redisPool.Get()
-		defer r.Close()
+	router.POST("/release/:qid", func(c *gin.Context) {
+		qid := sanitizeQid(c.Param("qid"))
+		item := sanitizeItem(c.PostForm("item"))
+		token := c.PostForm("token")
+		if token == "" {
+			c.String(http.StatusBadRequest, "token must be given.")
+			return
+		}
 
-		qids, err := redis.Strings(r.Do("SMEMBERS", "queues"))
+		position := param(c, "position")
+		if position == "" {
+			position = "head"
+		}
+		if position != "head" && position != "tail" {
+			c.String(http.StatusBadRequest, "position must be head or tail.")
+			return
+		}
+		due, err := dueParam(c)
 		if err != nil {
-			panic(err)
+			c.String(http.StatusBadRequest, err.Error())
+			return
 		}
 
-		for _, qid := range qids {
-			items, err := redis.Strings(r.Do("LRANGE", "queues-"+qid+"-pending", 0, -1))
+		if !queueExists(qid) {
+			c.String(http.StatusNotFound, "Queue "+qid+" does not exist.")
+		} else {
+			status, err := queues.Release(qid, item, token, position == "head", due)
 			if err != nil {
 				panic(err)
 			}
+			switch status {
+			case store.StatusOK:
+				c.String(http.StatusOK, item)
+			case store.StatusNotPending:
+				c.String(http.StatusBadRequest, "%s was not in pending.", item)
+			case store.StatusLeaseExpired:
+				c.String(http.StatusConflict, "The lease on %s has expired.", item)
+			case store.StatusConflict:
+				c.String(http.StatusConflict, "%s is leased with another token.", item)
+			}
+		}
+	})
 
-			for _, item := range items {
-				get, err := redis.String(r.Do("GET", "queues-"+qid+"-item-"+item+"-time"))
-				if get == "" {
-					_, err = r.Do("LREM", "queues-"+qid+"-pending", 1, item)
-					if err != nil {
-						panic(err)
-					}
-
-					_, err = r.Do("RPUSH", "queues-"+qid+"-queued", item)
-					if err != nil {
-						panic(err)
-					}
+	router.POST("/redrive/:qid", func(c *gin.Context) {
+		qid := sanitizeQid(c.Param("qid"))
 
-					log.Printf("Put expired item %v back to queue %v", item, qid)
-				}
+		if queueExists(qid) {
+			moved, err := queues.Redrive(qid)
+			if err != nil {
+				panic(err)
 			}
+			c.String(http.StatusOK, "%d", moved)
+		} else {
+			c.String(http.StatusNotFound, "Queue "+qid+" does not exist.")
 		}
-		c.String(http.StatusOK, "")
 	})
 
-	router.POST("/bulk/:qid", func(c *gin.Context) {
-		r := redisPool.Get()
-		defer r.Close()
+	router.POST("/remove/:qid", func(c *gin.Context) {
 		qid := sanitizeQid(c.Param("qid"))
-		clearQueue := c.Query("new") != ""
 		body, _ := ioutil.ReadAll(c.Request.Body)
-
-		if clearQueue && queueExists(r, qid) {
-			r.Send("DEL", "queues-"+qid+"-queued", "queues-"+qid+"-pending",
-				"queues-"+qid+"-done")
+		where, err := removeWhere(c.Query("from"))
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
 		}
 
-		r.Send("MULTI")
-		r.Send("SADD", "queues", qid)
+		if !queueExists(qid) {
+			c.String(http.StatusNotFound, "Queue "+qid+" does not exist.")
+			return
+		}
+		removed, err := queues.Remove(qid, where, parseItems(body))
+		if err != nil {
+			panic(err)
+		}
+		c.String(http.StatusOK, "%d", removed)
+	})
 
-		for _, line := range strings.Split(string(body[:]), "\n") {
-			item := strings.Trim(line, " \r\n")
-			r.Send("RPush", "queues-"+qid+"-queued", item)
+	router.POST("/purge/:qid", func(c *gin.Context) {
+		qid := sanitizeQid(c.Param("qid"))
+		where, err := removeWhere(param(c, "from"))
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		match, err := itemMatcher(param(c, "prefix"), param(c, "regex"))
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
 		}
 
-		_, err := r.Do("EXEC")
+		if !queueExists(qid) {
+			c.String(http.StatusNotFound, "Queue "+qid+" does not exist.")
+			return
+		}
+		removed, err := queues.Purge(qid, where, match)
 		if err != nil {
 			panic(err)
 		}
-		c.String(http.StatusOK, "")
+		c.String(http.StatusOK, "%d", removed)
 	})
 
-	monitorTimeout := func() {
-		for {
-			time.Sleep(5 * time.Second)
-			http.PostForm("http://127.0.0.1:"+port+"/_clean", url.Values{})
+	router.POST("/bulk/:qid", idempotent(queues), func(c *gin.Context) {
+		qid := sanitizeQid(c.Param("qid"))
+		clearQueue := c.Query("new") != ""
+		body, _ := ioutil.ReadAll(c.Request.Body)
+		due, err := dueParam(c)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
 		}
-	}
-	go monitorTimeout()
+		priority, ok := priorityParam(c)
+		if !ok {
+			c.String(http.StatusBadRequest, "priority must be a number.")
+			return
+		}
+
+		// The response lists the items left out as duplicates.
+		status, duplicates, err := queues.Bulk(qid, parseItems(body), priority, due, clearQueue)
+		if err != nil {
+			panic(err)
+		}
+		switch status {
+		case store.StatusMissing:
+			c.String(http.StatusNotFound, "Queue "+qid+" does not exist.")
+		case store.StatusDuplicate:
+			c.String(http.StatusConflict, strings.Join(duplicates, "\n"))
+		default:
+			c.String(http.StatusOK, strings.Join(duplicates, "\n"))
+		}
+	})
+
+	go newReaper(queues, reapInterval).run()
 
 	panic(router.Run(":" + port))
 }